@@ -1,9 +1,117 @@
 package common
 
+import (
+	"io"
+	"time"
+)
+
+// HostKeyPolicy defines how the SSH server host key is verified
+type HostKeyPolicy int
+
+const (
+	// verify the host key against KnownHostsFile and fail on unknown hosts
+	HostKeyKnownHosts HostKeyPolicy = iota
+	// trust on first use: unknown hosts are appended to KnownHostsFile,
+	// changed keys are still rejected
+	HostKeyTOFU
+	// verify the host key against HostKeyFingerprint
+	HostKeyFingerprint
+	// accept any host key
+	HostKeyInsecure
+)
+
+// AuthMethod identifies an SSH authentication method
+type AuthMethod int
+
+const (
+	// keys provided by ssh-agent (SSH_AUTH_SOCK)
+	AuthAgent AuthMethod = iota
+	// PrvtKeyFile, PrvtKeyFiles and their OpenSSH certificates
+	AuthPublicKey
+	AuthKeyboardInteractive
+	AuthPassword
+)
+
+// DefaultAuthOrder is used when Config.AuthOrder is empty
+var DefaultAuthOrder = []AuthMethod{AuthAgent, AuthPublicKey, AuthKeyboardInteractive, AuthPassword}
+
+// KeyboardInteractiveFunc answers keyboard-interactive challenges
+type KeyboardInteractiveFunc func(user, instruction string, questions []string, echos []bool) ([]string, error)
+
+// TransferMode selects the protocol used for file transfers
+type TransferMode int
+
+const (
+	// SFTP if the server provides the subsystem, SCP otherwise
+	TransferAuto TransferMode = iota
+	TransferSCP
+	TransferSFTP
+)
+
 type Config struct {
 	Host        string
 	Port        string
 	User        string
 	Password    string
 	PrvtKeyFile string
+
+	// additional private keys tried after PrvtKeyFile.
+	// A certificate found next to a key ("<key>-cert.pub") is used as well
+	PrvtKeyFiles []string
+	// passphrase for encrypted private keys
+	Passphrase string
+	// called for encrypted keys if Passphrase is empty
+	PassphraseFunc func(keyFile string) ([]byte, error)
+	// resolves Password and Passphrase lazily when they are empty
+	// (see ResolvePassword and ResolvePassphrase)
+	Credentials CredentialProvider
+	// authenticate with keys held by ssh-agent
+	UseAgent bool
+	// answers keyboard-interactive challenges.
+	// If nil, every challenge is answered with the password
+	KeyboardInteractive KeyboardInteractiveFunc
+	// order in which authentication methods are offered
+	AuthOrder []AuthMethod
+
+	// host key verification
+	HostKeyPolicy HostKeyPolicy
+	// path to the known_hosts file (defaults to ~/.ssh/known_hosts)
+	KnownHostsFile string
+	// SHA256 fingerprint ("SHA256:...") of the pinned host key
+	HostKeyFingerprint string
+
+	// dial and handshake timeout (no timeout if zero)
+	Timeout time.Duration
+	// interval between keepalive requests (disabled if zero)
+	KeepAliveInterval time.Duration
+	// unanswered keepalives before the connection is considered
+	// broken (defaults to 3)
+	KeepAliveCountMax int
+
+	// protocol used by upload and download
+	Transfer TransferMode
+
+	// hosts the connection is tunneled through, in order (ProxyJump).
+	// Every hop is authenticated and verified by its own settings,
+	// their JumpHosts and Proxy are ignored
+	JumpHosts []*Config
+	// proxy used to reach the first hop:
+	// "socks5://[user:password@]host:port" or
+	// "http://[user:password@]host:port" (HTTP CONNECT)
+	Proxy string
+
+	// dry-run: commands, uploads and file changes are logged to DryRun
+	// instead of being done.The host is still connected to for reading
+	DryRun io.Writer
+	// operations done are recorded to the transcript.
+	// A replayed transcript answers them instead and no connection is made
+	Transcript *Transcript
+
+	// retries dialing, opening sessions, transfers and sshfs mounts
+	// failed by transient errors (single attempt if nil)
+	Retry *RetryPolicy
+
+	// secrets supplied by Credentials so far (see Secrets).
+	// Shared by the copies of the config made afterwards
+	resolved map[string]struct{}
 }
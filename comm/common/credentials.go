@@ -0,0 +1,254 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// CredentialKind identifies the requested secret
+type CredentialKind int
+
+const (
+	// login password of Config.User
+	CredentialPassword CredentialKind = iota
+	// passphrase of encrypted private key
+	CredentialPassphrase
+)
+
+func (k CredentialKind) String() string {
+	if k == CredentialPassphrase {
+		return "passphrase"
+	}
+	return "password"
+}
+
+// CredentialRequest describes the secret requested from a provider
+type CredentialRequest struct {
+	Kind CredentialKind
+	Host string
+	Port string
+	User string
+	// private key file the passphrase is requested for
+	KeyFile string
+}
+
+// CredentialProvider supplies secrets on demand.
+// Providers are asked only when the secret is actually needed
+// for authentication
+type CredentialProvider interface {
+	Credential(req *CredentialRequest) (string, error)
+}
+
+// CredentialFunc adapts a function to CredentialProvider
+type CredentialFunc func(req *CredentialRequest) (string, error)
+
+func (f CredentialFunc) Credential(req *CredentialRequest) (string, error) {
+	return f(req)
+}
+
+var (
+	ErrNoCredential           = errors.New("credential is not available")
+	ErrInsecureCredentialFile = errors.New("credential file is accessible by other users")
+)
+
+// EnvCredential reads the secret from the environment variable
+func EnvCredential(name string) CredentialProvider {
+	return CredentialFunc(func(req *CredentialRequest) (string, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: %w", name, ErrNoCredential)
+		}
+		return v, nil
+	})
+}
+
+// FileCredential reads the secret from the first line of the file.
+// The file must be owned by the current user and must not be accessible
+// by group and others (like ~/.ssh keys)
+func FileCredential(path string) CredentialProvider {
+	return CredentialFunc(func(req *CredentialRequest) (string, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return "", fmt.Errorf("%s: %w (mode %04o)", path, ErrInsecureCredentialFile, info.Mode().Perm())
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+			return "", fmt.Errorf("%s: %w (owned by uid %d)", path, ErrInsecureCredentialFile, st.Uid)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(line, "\r"), nil
+	})
+}
+
+// PromptCredential asks the user for the secret on the controlling
+// terminal without echoing it
+func PromptCredential() CredentialProvider {
+	return CredentialFunc(func(req *CredentialRequest) (string, error) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return "", fmt.Errorf("no terminal to prompt for %s: %w", req.Kind, err)
+		}
+		defer tty.Close()
+		if req.Kind == CredentialPassphrase {
+			fmt.Fprintf(tty, "Enter passphrase for key '%s': ", req.KeyFile)
+		} else {
+			fmt.Fprintf(tty, "%s@%s's password: ", req.User, req.Host)
+		}
+		secret, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		if err != nil {
+			return "", err
+		}
+		return string(secret), nil
+	})
+}
+
+// HelperCredential runs the command (by /bin/sh) in the style of git
+// credential helpers: "<command> get" is given the request on stdin as
+//
+//	protocol=ssh
+//	host=<host>:<port>
+//	username=<user>
+//	kind=<password|passphrase>
+//	path=<key file>
+//
+// and is expected to print "password=<secret>" line
+func HelperCredential(command string) CredentialProvider {
+	return CredentialFunc(func(req *CredentialRequest) (string, error) {
+		var input bytes.Buffer
+		fmt.Fprintf(&input, "protocol=ssh\nhost=%s:%s\nusername=%s\nkind=%s\n", req.Host, req.Port, req.User, req.Kind)
+		if req.KeyFile != "" {
+			fmt.Fprintf(&input, "path=%s\n", req.KeyFile)
+		}
+		input.WriteString("\n")
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", command+" get")
+		cmd.Stdin = &input
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			// the output may contain the secret
+			return "", fmt.Errorf("credential helper %q: %s [%s]", command, strings.TrimSpace(stderr.String()), err)
+		}
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			if v, ok := strings.CutPrefix(scanner.Text(), "password="); ok {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("credential helper %q: %w", command, ErrNoCredential)
+	})
+}
+
+// CachedCredential remembers the secrets supplied by the provider
+// so that it is asked once per host, user and key file
+func CachedCredential(p CredentialProvider) CredentialProvider {
+	var mu sync.Mutex
+	cache := make(map[CredentialRequest]string)
+	return CredentialFunc(func(req *CredentialRequest) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if secret, ok := cache[*req]; ok {
+			return secret, nil
+		}
+		secret, err := p.Credential(req)
+		if err != nil {
+			return "", err
+		}
+		cache[*req] = secret
+		return secret, nil
+	})
+}
+
+// resolvedMu guards Config.resolved of all the configs
+var resolvedMu sync.Mutex
+
+// resolve asks Credentials and remembers the secret for redaction
+func (c *Config) resolve(req *CredentialRequest) (string, error) {
+	secret, err := c.Credentials.Credential(req)
+	if err != nil {
+		return "", err
+	}
+	if secret != "" {
+		resolvedMu.Lock()
+		if c.resolved == nil {
+			c.resolved = make(map[string]struct{})
+		}
+		c.resolved[secret] = struct{}{}
+		resolvedMu.Unlock()
+	}
+	return secret, nil
+}
+
+// resolvedSecrets returns the secrets supplied by Credentials so far
+func (c *Config) resolvedSecrets() []string {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	secrets := make([]string, 0, len(c.resolved))
+	for s := range c.resolved {
+		secrets = append(secrets, s)
+	}
+	return secrets
+}
+
+// ForgetSecrets stops redacting the secrets supplied by Credentials
+// (all of them if none is given), e.g. once they are rotated.
+// The copies of the config forget them as well
+func (c *Config) ForgetSecrets(secrets ...string) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	if len(secrets) == 0 {
+		clear(c.resolved)
+		return
+	}
+	for _, s := range secrets {
+		delete(c.resolved, s)
+	}
+}
+
+// ResolvePassword returns Password or asks Credentials for it.
+// Returns empty string if neither is set
+func (c *Config) ResolvePassword() (string, error) {
+	if c.Password != "" || c.Credentials == nil {
+		return c.Password, nil
+	}
+	return c.resolve(&CredentialRequest{
+		Kind: CredentialPassword,
+		Host: c.Host,
+		Port: c.Port,
+		User: c.User,
+	})
+}
+
+// ResolvePassphrase returns Passphrase or asks Credentials for
+// the passphrase of the key file.
+// Returns empty string if neither is set
+func (c *Config) ResolvePassphrase(keyFile string) (string, error) {
+	if c.Passphrase != "" || c.Credentials == nil {
+		return c.Passphrase, nil
+	}
+	return c.resolve(&CredentialRequest{
+		Kind:    CredentialPassphrase,
+		Host:    c.Host,
+		Port:    c.Port,
+		User:    c.User,
+		KeyFile: keyFile,
+	})
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces secrets in error messages and String() output
+const Redacted = "********"
+
+// MinRedactLength is the length of the shortest secret redacted.
+// Shorter ones would garble unrelated text
+const MinRedactLength = 4
+
+// Redact replaces every occurrence of the secrets in s.
+// Secrets shorter than MinRedactLength are left as is
+func Redact(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if len(secret) >= MinRedactLength {
+			s = strings.ReplaceAll(s, secret, Redacted)
+		}
+	}
+	return s
+}
+
+// RedactError hides the secrets in the message of err.
+// The wrapped error is still available to errors.Is and errors.As
+func RedactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if redacted := Redact(msg, secrets...); redacted != msg {
+		return &redactedError{msg: redacted, err: err}
+	}
+	return err
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Secrets returns the secrets set in the config, its jump hosts and
+// the proxy URL along with the secrets their Credentials supplied so far
+func (c *Config) Secrets() []string {
+	secrets := c.resolvedSecrets()
+	for _, s := range []string{c.Password, c.Passphrase, proxyPassword(c.Proxy)} {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	for _, hop := range c.JumpHosts {
+		secrets = append(secrets, hop.Secrets()...)
+	}
+	return secrets
+}
+
+func proxyPassword(proxy string) string {
+	if proxy == "" {
+		return ""
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.User == nil {
+		return ""
+	}
+	pass, _ := u.User.Password()
+	return pass
+}
+
+// String returns "user@host:port" of the config
+func (c Config) String() string {
+	return fmt.Sprintf("%s@%s:%s", c.User, c.Host, c.Port)
+}
+
+// GoString prints the config with secrets redacted
+func (c Config) GoString() string {
+	// the local type has no methods, so the printing does not recurse
+	type config Config
+	cp := config(c)
+	if cp.Password != "" {
+		cp.Password = Redacted
+	}
+	if cp.Passphrase != "" {
+		cp.Passphrase = Redacted
+	}
+	if proxyPassword(cp.Proxy) != "" {
+		u, _ := url.Parse(cp.Proxy)
+		user := url.User(u.User.Username()).String()
+		cp.Proxy = strings.Replace(u.String(), u.User.String()+"@", user+":"+Redacted+"@", 1)
+	}
+	return "common.Config" + strings.TrimPrefix(fmt.Sprintf("%#v", cp), "common.config")
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Result represents outcome of a command executed on local or remote host
+type Result struct {
+	// the executed command line
+	Command string
+	Stdout  string
+	Stderr  string
+	// -1 if the command was terminated by a signal
+	// or the exit status is unknown
+	ExitStatus int
+	// name of the signal terminated the command ("TERM", "KILL"...)
+	Signal   string
+	Duration time.Duration
+}
+
+// Success reports whether the command exited with zero status
+func (r *Result) Success() bool {
+	return r.ExitStatus == 0 && r.Signal == ""
+}
+
+// ExitError is returned when a command exits with non-zero status
+// or is terminated by a signal
+type ExitError struct {
+	*Result
+}
+
+func (e *ExitError) Error() string {
+	status := fmt.Sprintf("exit status %d", e.ExitStatus)
+	if e.Signal != "" {
+		status = "signal " + e.Signal
+	}
+	return fmt.Sprintf("executing %s : %s [%s]", e.Command, strings.TrimSpace(e.Stderr), status)
+}
+
+// ExitCode returns exit status of the command
+func (e *ExitError) ExitCode() int {
+	return e.ExitStatus
+}
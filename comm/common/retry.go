@@ -0,0 +1,201 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy retries failed operations with exponential backoff.
+// The zero value makes DefaultMaxAttempts attempts with the default delays
+type RetryPolicy struct {
+	// attempts including the first one (DefaultMaxAttempts if zero)
+	MaxAttempts int
+	// delay before the first retry (100ms if zero)
+	InitialDelay time.Duration
+	// the delay is doubled up to MaxDelay (10s if zero)
+	MaxDelay time.Duration
+	// the delay is randomized by up to the fraction of it (0.2 if zero,
+	// no jitter if negative)
+	Jitter float64
+	// no retry is started once Deadline passes since the first attempt
+	// (no limit if zero)
+	Deadline time.Duration
+	// reports whether the error is worth retrying (IsRetryable if nil)
+	Retryable func(err error) bool
+	// called before sleeping ahead of the retry
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+const DefaultMaxAttempts = 3
+
+// NoRetry makes a single attempt
+var NoRetry = &RetryPolicy{MaxAttempts: 1}
+
+// RetryError is returned once the attempts are exhausted.
+// It wraps the error of the last attempt
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s [%d attempts]", e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// permanentError stops retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying regardless of its kind.
+// Do returns err as is
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// Do calls fn until it succeeds, fails with an error not worth retrying,
+// the attempts are exhausted, the deadline passes or ctx is done.
+// A nil policy makes a single attempt
+func (p *RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p == nil {
+		p = NoRetry
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := p.delay(attempt)
+		if attempt >= maxAttempts || (p.Deadline > 0 && time.Since(start)+delay > p.Deadline) {
+			if attempt == 1 {
+				return err
+			}
+			return &RetryError{Attempts: attempt, Err: err}
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns the delay before the retry following the attempt
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = 0.2
+	}
+	if jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * jitter * float64(delay))
+	}
+	return delay
+}
+
+// transient failures whose type is lost on the way (command output)
+var retryableMessages = []string{
+	"connection refused",
+	"connection reset by peer",
+	"transport endpoint is not connected",
+	"handshake failed: eof",
+	"no route to host",
+	"network is unreachable",
+	"connection timed out",
+}
+
+// IsRetryable reports whether err is a transient network failure:
+// refused or reset connection, handshake cut by EOF, session channel
+// rejected for lack of resources or MaxSessions exhaustion, timeout,
+// stale sshfs mount (transport endpoint is not connected).
+// Authentication and host key failures as well as non-zero exit
+// status of commands are not retryable
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var exitErr *ExitError
+	var openErr *ssh.OpenChannelError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &exitErr):
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &openErr):
+		// OpenSSH rejects sessions beyond MaxSessions as prohibited
+		return openErr.Reason != ssh.UnknownChannelType
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.ENOTCONN),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 4, InitialDelay: time.Millisecond, Jitter: -1}
+	attempts := 0
+	err := p.Do(context.Background(), func(context.Context) error {
+		if attempts++; attempts < 3 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("got %v after %d attempts", err, attempts)
+	}
+
+	attempts = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+	})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 4 || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected RetryError after 4 attempts, got %v", err)
+	}
+
+	// not retryable
+	attempts = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return errors.New("ssh: unable to authenticate")
+	})
+	if attempts != 1 || errors.As(err, &retryErr) {
+		t.Fatalf("got %v after %d attempts", err, attempts)
+	}
+	attempts = 0
+	p.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return Permanent(io.EOF)
+	})
+	if attempts != 1 {
+		t.Fatalf("permanent error retried %d times", attempts)
+	}
+
+	// the deadline stops retrying before the attempts are exhausted
+	p = &RetryPolicy{MaxAttempts: 100, InitialDelay: 20 * time.Millisecond, Jitter: -1, Deadline: 50 * time.Millisecond}
+	attempts = 0
+	p.Do(context.Background(), func(context.Context) error {
+		attempts++
+		return io.EOF
+	})
+	if attempts < 2 || attempts > 3 {
+		t.Fatalf("%d attempts within the deadline", attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: -1}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: time.Second} {
+		if got := p.delay(attempt); got != want {
+			t.Fatalf("attempt %d: got %s, want %s", attempt, got, want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("delay %s out of the jitter range", d)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for err, want := range map[error]bool{
+		&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}:  true,
+		fmt.Errorf("ssh: handshake failed: %w", io.EOF):                  true,
+		&ssh.OpenChannelError{Reason: ssh.ResourceShortage}:              true,
+		&ssh.OpenChannelError{Reason: ssh.Prohibited}:                    true,
+		&ssh.OpenChannelError{Reason: ssh.UnknownChannelType}:            false,
+		errors.New("fuse: Transport endpoint is not connected [exit 1]"): true,
+		errors.New("ssh: unable to authenticate"):                        false,
+		&ExitError{&Result{ExitStatus: 7, Stderr: "connection refused"}}: false,
+		context.Canceled: false,
+	} {
+		if got := IsRetryable(err); got != want {
+			t.Errorf("%v: got %t, want %t", err, got, want)
+		}
+	}
+}
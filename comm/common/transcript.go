@@ -0,0 +1,200 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotRecorded is returned in replay mode for operations
+// missing in the transcript
+var ErrNotRecorded = errors.New("operation is not recorded in the transcript")
+
+// Entry is an operation recorded in the transcript
+type Entry struct {
+	// "user@host:port" or "local"
+	Host string `json:"host"`
+	// "run", "upload", "download", "write", "mkdir", "remove", "rename", "chmod"...
+	Op string `json:"op"`
+	// the command or the paths
+	Args       []string      `json:"args"`
+	Stdout     string        `json:"stdout,omitempty"`
+	Stderr     string        `json:"stderr,omitempty"`
+	ExitStatus int           `json:"exit_status"`
+	Signal     string        `json:"signal,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+	// error other than non-zero exit status
+	Error string `json:"error,omitempty"`
+}
+
+// Transcript collects the executed operations with their results.
+// A transcript loaded by LoadTranscript or ReadTranscript is replayed:
+// the operations are answered from the transcript instead of being done,
+// so tests do not need real hosts
+type Transcript struct {
+	mu      sync.Mutex
+	entries []*Entry
+	replay  bool
+	used    []bool
+}
+
+// NewTranscript returns an empty transcript in recording mode
+func NewTranscript() *Transcript {
+	return &Transcript{}
+}
+
+// LoadTranscript loads the transcript saved by Save for replaying
+func LoadTranscript(path string) (*Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTranscript(f)
+}
+
+// ReadTranscript reads JSON transcript for replaying
+func ReadTranscript(r io.Reader) (*Transcript, error) {
+	var entries []*Entry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid transcript: %w", err)
+	}
+	return &Transcript{entries: entries, replay: true, used: make([]bool, len(entries))}, nil
+}
+
+// Replaying reports whether the operations are answered from the transcript
+func (t *Transcript) Replaying() bool {
+	return t.replay
+}
+
+// Entries returns the recorded operations
+func (t *Transcript) Entries() []*Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Entry(nil), t.entries...)
+}
+
+// WriteTo writes the transcript as JSON
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(t.Entries(), "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// Save writes the transcript to the file
+func (t *Transcript) Save(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".transcript")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := t.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Record appends the operation with its outcome.res may be nil
+func (t *Transcript) Record(host, op string, args []string, res *Result, err error) {
+	e := &Entry{Host: host, Op: op, Args: args}
+	if res != nil {
+		e.Stdout = res.Stdout
+		e.Stderr = res.Stderr
+		e.ExitStatus = res.ExitStatus
+		e.Signal = res.Signal
+		e.Duration = res.Duration
+	}
+	var exitErr *ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		e.Error = err.Error()
+	}
+	t.mu.Lock()
+	t.entries = append(t.entries, e)
+	t.mu.Unlock()
+}
+
+// Replay returns outcome of the first operation not replayed yet
+// matching host, op and args.
+// Commands exited with non-zero status yield *ExitError
+func (t *Transcript) Replay(host, op string, args ...string) (*Result, error) {
+	if !t.replay {
+		return nil, errors.New("transcript is recording, not replaying")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, e := range t.entries {
+		if t.used[i] || e.Host != host || e.Op != op || !equalArgs(e.Args, args) {
+			continue
+		}
+		t.used[i] = true
+		res := &Result{
+			Stdout:     e.Stdout,
+			Stderr:     e.Stderr,
+			ExitStatus: e.ExitStatus,
+			Signal:     e.Signal,
+			Duration:   e.Duration,
+		}
+		if op == "run" {
+			res.Command = args[0]
+		}
+		switch {
+		case e.Error != "":
+			return res, errors.New(e.Error)
+		case !res.Success():
+			return res, &ExitError{Result: res}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("%s %s %s: %w", host, op, strings.Join(args, " "), ErrNotRecorded)
+}
+
+// Pending returns the recorded operations not replayed yet
+func (t *Transcript) Pending() []*Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pending []*Entry
+	for i, e := range t.entries {
+		if t.replay && !t.used[i] {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dryRunMu serializes the dry-run logs written by concurrent operations
+var dryRunMu sync.Mutex
+
+// LogDryRun logs the operation skipped in dry-run mode.
+// The log may be shared by concurrent operations
+func LogDryRun(w io.Writer, host, op string, args ...string) {
+	line := fmt.Sprintf("[dry-run] %s: %s %s\n", host, op, strings.Join(args, " "))
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	io.WriteString(w, line)
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTranscriptReplay(t *testing.T) {
+	rec := NewTranscript()
+	rec.Record("u@h:22", "run", []string{"uname"}, &Result{Stdout: "Linux\n"}, nil)
+	rec.Record("u@h:22", "run", []string{"false"}, &Result{ExitStatus: 1, Stderr: "oops"}, &ExitError{})
+	rec.Record("u@h:22", "upload", []string{"a", "b"}, nil, errors.New("no space left"))
+	rec.Record("u@h:22", "run", []string{"uname"}, &Result{Stdout: "Darwin\n"}, nil)
+
+	var buf bytes.Buffer
+	if _, err := rec.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := ReadTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replay.Replaying() || rec.Replaying() {
+		t.Fatal("wrong mode")
+	}
+
+	res, err := replay.Replay("u@h:22", "run", "uname")
+	if err != nil || res.Stdout != "Linux\n" || res.Command != "uname" {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	// repeated commands are answered in order
+	if res, _ := replay.Replay("u@h:22", "run", "uname"); res.Stdout != "Darwin\n" {
+		t.Fatalf("got %q", res.Stdout)
+	}
+	var exitErr *ExitError
+	if _, err := replay.Replay("u@h:22", "run", "false"); !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if _, err := replay.Replay("u@h:22", "upload", "a", "b"); err == nil || err.Error() != "no space left" {
+		t.Fatalf("expected recorded error, got %v", err)
+	}
+	if _, err := replay.Replay("other:22", "run", "uname"); !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("expected ErrNotRecorded, got %v", err)
+	}
+	if len(replay.Pending()) != 0 {
+		t.Fatalf("pending %v", replay.Pending())
+	}
+}
+
+func TestLogDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	LogDryRun(&buf, "u@h:22", "upload", "a", "b")
+	if got := buf.String(); !strings.Contains(got, "u@h:22: upload a b") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// overlapWriter fails the test on concurrent writes
+type overlapWriter struct {
+	t     *testing.T
+	mu    sync.Mutex
+	lines int
+}
+
+func (w *overlapWriter) Write(p []byte) (int, error) {
+	if !w.mu.TryLock() {
+		w.t.Error("concurrent write")
+		return len(p), nil
+	}
+	defer w.mu.Unlock()
+	w.lines += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+func TestLogDryRunConcurrent(t *testing.T) {
+	w := &overlapWriter{t: t}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				LogDryRun(w, "u@h:22", "run", "uname", "-a")
+			}
+		}()
+	}
+	wg.Wait()
+	if w.lines != 1000 {
+		t.Errorf("got %d lines", w.lines)
+	}
+}
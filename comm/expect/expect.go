@@ -0,0 +1,201 @@
+// Package expect scripts interactive sessions: it waits for the output
+// to match patterns and sends responses
+package expect
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var ErrTimeout = errors.New("expect: timeout")
+
+// Expecter reads the session output in the background and lets
+// the caller wait for it to match patterns
+type Expecter struct {
+	w io.Writer
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// the whole output is copied to log if set
+	log io.Writer
+	// output goes straight to passthrough once Interact is called
+	passthrough io.Writer
+	// read error, io.EOF once the output is over
+	err error
+	// closed on every read
+	changed chan struct{}
+	// closed once the output is over
+	done chan struct{}
+}
+
+// New starts reading the session output from r.
+// Responses are written to w
+func New(r io.Reader, w io.Writer) *Expecter {
+	e := &Expecter{
+		w:       w,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.read(r)
+	return e
+}
+
+// SetLog copies the output (including the output read so far) to w
+func (e *Expecter) SetLog(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.log = w
+	if w != nil {
+		w.Write(e.buf.Bytes())
+	}
+}
+
+func (e *Expecter) read(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		e.mu.Lock()
+		if n > 0 {
+			if e.log != nil {
+				e.log.Write(buf[:n])
+			}
+			if e.passthrough != nil {
+				e.passthrough.Write(buf[:n])
+			} else {
+				e.buf.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			e.err = err
+			close(e.done)
+		}
+		close(e.changed)
+		e.changed = make(chan struct{})
+		e.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Send writes s to the session
+func (e *Expecter) Send(s string) error {
+	_, err := io.WriteString(e.w, s)
+	return err
+}
+
+// SendLine writes s followed by newline to the session
+func (e *Expecter) SendLine(s string) error {
+	return e.Send(s + "\n")
+}
+
+// Expect waits for the output to match any of the patterns.
+// Returns index of the pattern matched first in the output along with
+// the match and its submatches.The output is consumed up to the end of
+// the match.
+// Returns ErrTimeout if nothing matches within timeout (no timeout if
+// zero) and io.EOF or the read error if the output is over
+func (e *Expecter) Expect(timeout time.Duration, patterns ...*regexp.Regexp) (int, []string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		e.mu.Lock()
+		data := e.buf.Bytes()
+		idx := -1
+		var loc []int
+		for i, re := range patterns {
+			if l := re.FindSubmatchIndex(data); l != nil && (idx < 0 || l[0] < loc[0]) {
+				idx, loc = i, l
+			}
+		}
+		if idx >= 0 {
+			match := make([]string, len(loc)/2)
+			for i := range match {
+				if loc[2*i] >= 0 {
+					match[i] = string(data[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			e.buf.Next(loc[1])
+			e.mu.Unlock()
+			return idx, match, nil
+		}
+		err, changed := e.err, e.changed
+		e.mu.Unlock()
+		if err != nil {
+			return -1, nil, err
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return -1, nil, ErrTimeout
+		}
+	}
+}
+
+// ExpectString waits for the output to contain s
+func (e *Expecter) ExpectString(timeout time.Duration, s string) error {
+	_, _, err := e.Expect(timeout, regexp.MustCompile(regexp.QuoteMeta(s)))
+	return err
+}
+
+// Buffered returns the output read but not consumed by Expect yet
+func (e *Expecter) Buffered() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.buf.String()
+}
+
+// Canceler is implemented by readers whose pending Read can be
+// interrupted without consuming input (see pty.Interact)
+type Canceler interface {
+	Cancel()
+}
+
+// Interact hands the session over to the user: the pending and further
+// output is written to stdout and stdin is sent to the session.
+// Returns once the output is over.
+// If stdin implements Canceler, it is canceled and the copy is over
+// before Interact returns, otherwise the copy goes on until stdin
+// is over or the session stops accepting input
+func (e *Expecter) Interact(stdin io.Reader, stdout io.Writer) error {
+	e.mu.Lock()
+	if _, err := stdout.Write(e.buf.Bytes()); err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	e.buf.Reset()
+	e.passthrough = stdout
+	e.mu.Unlock()
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(e.w, stdin)
+	}()
+	err := e.Wait()
+	if c, ok := stdin.(Canceler); ok {
+		c.Cancel()
+		<-copied
+	}
+	return err
+}
+
+// Wait waits for the output to be over.
+// Returns nil if it ended by io.EOF
+func (e *Expecter) Wait() error {
+	<-e.done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == io.EOF {
+		return nil
+	}
+	return e.err
+}
@@ -0,0 +1,110 @@
+package expect
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpect(t *testing.T) {
+	r, w := io.Pipe()
+	var sent bytes.Buffer
+	e := New(r, &sent)
+
+	go io.WriteString(w, "login: ")
+	if err := e.ExpectString(time.Second, "login:"); err != nil {
+		t.Fatal(err)
+	}
+	e.SendLine("root")
+	if sent.String() != "root\n" {
+		t.Errorf("unexpected input %q", sent.String())
+	}
+
+	// the pattern matched first in the output wins
+	go io.WriteString(w, "Password: ...\nlast login 12\n")
+	idx, match, err := e.Expect(time.Second, regexp.MustCompile(`login (\d+)`), regexp.MustCompile(`Password:`))
+	if err != nil || idx != 1 || match[0] != "Password:" {
+		t.Fatalf("unexpected match %d %q %v", idx, match, err)
+	}
+	idx, match, err = e.Expect(time.Second, regexp.MustCompile(`login (\d+)`))
+	if err != nil || idx != 0 || match[1] != "12" {
+		t.Fatalf("unexpected match %d %q %v", idx, match, err)
+	}
+
+	if _, _, err := e.Expect(50*time.Millisecond, regexp.MustCompile(`never`)); err != ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	go func() {
+		io.WriteString(w, "bye\n")
+		w.Close()
+	}()
+	if _, _, err := e.Expect(time.Second, regexp.MustCompile(`never`)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if e.Buffered() != "\nbye\n" {
+		t.Errorf("unexpected pending output %q", e.Buffered())
+	}
+}
+
+func TestInteract(t *testing.T) {
+	r, w := io.Pipe()
+	var sent, log, stdout bytes.Buffer
+	e := New(r, &sent)
+	e.SetLog(&log)
+
+	io.WriteString(w, "prompt> ")
+	if err := e.ExpectString(time.Second, "prompt"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.WriteString(w, "output\n")
+		w.Close()
+	}()
+	if err := e.Interact(strings.NewReader("input\n"), &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(stdout.String(), "output\n") || !strings.HasPrefix(stdout.String(), ">") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	if log.String() != "prompt> output\n" {
+		t.Errorf("unexpected log %q", log.String())
+	}
+}
+
+// blockingReader blocks until canceled
+type blockingReader struct {
+	canceled chan struct{}
+	returned int32
+}
+
+func (r *blockingReader) Read(b []byte) (int, error) {
+	<-r.canceled
+	atomic.StoreInt32(&r.returned, 1)
+	return 0, io.EOF
+}
+
+func (r *blockingReader) Cancel() {
+	close(r.canceled)
+}
+
+func TestInteractCancel(t *testing.T) {
+	r, w := io.Pipe()
+	var sent, stdout bytes.Buffer
+	e := New(r, &sent)
+	stdin := &blockingReader{canceled: make(chan struct{})}
+	go func() {
+		io.WriteString(w, "bye\n")
+		w.Close()
+	}()
+	if err := e.Interact(stdin, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&stdin.returned) != 1 {
+		t.Fatal("stdin is still read after Interact")
+	}
+}
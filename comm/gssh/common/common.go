@@ -1,48 +1,253 @@
 package common
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/dorzheh/gexpect"
 	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/expect"
+	"github.com/dorzheh/infra/comm/pty"
 )
 
-var ask_known_hosts = regexp.MustCompile(`Are you sure you want to continue connecting (yes/no)?`)
-var ask_password = regexp.MustCompile(`password:`)
+// DefaultExpectTimeout is used when Client.ExpectTimeout is not set
+const DefaultExpectTimeout = 10 * time.Second
+
+// output kept for classifying failures
+const maxTranscript = 64 * 1024
 
 type Client struct {
 	*common.Config
+	// prompts answered before the child is handed over to the user
+	// (DefaultPrompts if nil)
+	Prompts []*Prompt
+	// classify the output of the failed child (DefaultFailures if nil)
+	Failures []*Failure
+	// max wait for the next prompt.Once it expires the child is
+	// handed over to the user (DefaultExpectTimeout if zero)
+	ExpectTimeout time.Duration
+	// the child is killed once it runs longer (no limit if zero)
+	InteractTimeout time.Duration
+	// answers one-time password and verification code prompts
+	OTP func(prompt string) (string, error)
 }
 
 func NewClient(config *common.Config) *Client {
-	return &Client{config}
+	return &Client{Config: config}
 }
 
+// Run runs the command split by white space.
+// The child is killed once timeout expires (InteractTimeout if zero).
+//
+// Deprecated: quoting is not supported, use RunArgs
 func (c *Client) Run(cmd string, timeout time.Duration) error {
-	cmdSlice := strings.Split(cmd, " ")
-	child, err := gexpect.NewSubProcess(cmdSlice[0], cmdSlice[1:]...)
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+	if timeout == 0 {
+		timeout = c.InteractTimeout
+	}
+	return c.run(exec.Command(args[0], args[1:]...), timeout)
+}
+
+// RunArgs runs the program with the arguments as is (no shell is involved).
+// Returns *Error if the program fails
+func (c *Client) RunArgs(name string, args ...string) error {
+	return c.run(exec.Command(name, args...), c.InteractTimeout)
+}
+
+// run runs the child honoring dry-run, recording and replay modes
+// of the config
+func (c *Client) run(child *exec.Cmd, timeout time.Duration) error {
+	command := strings.Join(child.Args, " ")
+	if c.Config != nil {
+		switch {
+		case c.DryRun != nil:
+			common.LogDryRun(c.DryRun, c.Config.String(), "run", command)
+			return nil
+		case c.Transcript != nil && c.Transcript.Replaying():
+			return c.replay(command)
+		case c.Transcript != nil:
+			output, err := c.execute(child, timeout)
+			c.record(command, output, err)
+			return err
+		}
+	}
+	_, err := c.execute(child, timeout)
+	return err
+}
+
+// execute runs the child with pseudo-terminal, answers its prompts
+// and then hands it over to the user.
+// Returns tail of the child output
+func (c *Client) execute(child *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	p, err := pty.Start(child)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer p.Close()
+
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			child.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+	transcript := &tailBuffer{max: maxTranscript}
+	e := expect.New(p, p)
+	e.SetLog(transcript)
+
+	command := strings.Join(child.Args, " ")
+	if err := c.answer(e); err != nil {
+		child.Process.Kill()
+		child.Wait()
+		var perr *promptError
+		if errors.As(err, &perr) {
+			return nil, &Error{Command: command, Kind: ErrPromptRepeated, Message: perr.prompt, ExitStatus: -1}
+		}
+		e := &Error{Command: command, Message: err.Error(), ExitStatus: -1}
+		if errors.Is(err, ErrHostKeyVerification) {
+			e.Kind = ErrHostKeyVerification
+		}
+		return nil, e
+	}
+	if err := pty.Interact(e, os.Stdin, os.Stdout, p.Resize); err != nil {
+		child.Process.Kill()
+		child.Wait()
+		return nil, err
+	}
+
+	err = child.Wait()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return transcript.Bytes(), &Error{Command: command, Kind: ErrTimeout, ExitStatus: -1}
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return transcript.Bytes(), err
+	}
+	failures := c.Failures
+	if failures == nil {
+		failures = DefaultFailures
+	}
+	msg, kind := classify(failures, transcript.Bytes())
+	return transcript.Bytes(), &Error{Command: command, Kind: kind, Message: msg, ExitStatus: exitErr.ExitCode()}
+}
+
+// record records the outcome of the child.
+// The output is recorded for classifying the replayed failures
+func (c *Client) record(command string, output []byte, err error) {
+	res := &common.Result{Command: command, Stdout: common.Redact(string(output), c.Secrets()...)}
+	var e *Error
+	if errors.As(err, &e) {
+		res.ExitStatus = e.ExitStatus
+		err = nil
+		if e.ExitStatus == -1 {
+			// killed, the reason is recorded instead of the output
+			res.Stdout = e.Message
+			err = errors.New(e.Message)
+			if e.Kind != nil {
+				err = e.Kind
+			}
+		}
 	}
-	return c.expect(child, 0, 0)
+	c.Transcript.Record(c.Config.String(), "run", []string{command}, res, err)
 }
 
-func (c *Client) expect(child *gexpect.SubProcess, expectTimeoutSec, interactTimeoutSec time.Duration) error {
-	defer child.Close()
-	if err := child.Start(); err != nil {
+// replay returns the recorded outcome of the child
+func (c *Client) replay(command string) error {
+	res, err := c.Transcript.Replay(c.Config.String(), "run", command)
+	if res == nil || err == nil {
 		return err
 	}
-	if idx, _ := child.ExpectTimeout(expectTimeoutSec*time.Second, ask_known_hosts, ask_password); idx >= 0 {
-		if idx == 0 {
-			child.SendLine("yes")
-			if idx, _ := child.ExpectTimeout(expectTimeoutSec*time.Second, ask_password); idx >= 0 {
-				child.SendLine(c.Password)
+	if res.ExitStatus == -1 {
+		e := &Error{Command: command, Message: res.Stdout, ExitStatus: -1}
+		for _, kind := range []error{ErrPromptRepeated, ErrTimeout, ErrHostKeyVerification} {
+			if err.Error() == kind.Error() {
+				e.Kind = kind
 			}
-		} else if idx == 1 {
-			child.SendLine(c.Password)
+		}
+		return e
+	}
+	var exitErr *common.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	failures := c.Failures
+	if failures == nil {
+		failures = DefaultFailures
+	}
+	msg, kind := classify(failures, []byte(res.Stdout))
+	return &Error{Command: command, Kind: kind, Message: msg, ExitStatus: res.ExitStatus}
+}
+
+// promptError is returned by answer if a prompt is repeated
+type promptError struct {
+	prompt string
+}
+
+func (e *promptError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrPromptRepeated, e.prompt)
+}
+
+// answer responds to the prompts until none appears within ExpectTimeout
+// or the output is over
+func (c *Client) answer(e *expect.Expecter) error {
+	prompts := c.Prompts
+	if prompts == nil {
+		prompts = DefaultPrompts
+	}
+	timeout := c.ExpectTimeout
+	if timeout == 0 {
+		timeout = DefaultExpectTimeout
+	}
+	patterns := make([]*regexp.Regexp, len(prompts))
+	for i, p := range prompts {
+		patterns[i] = p.Pattern
+	}
+	answered := make([]int, len(prompts))
+	for {
+		idx, match, err := e.Expect(timeout, patterns...)
+		if err != nil {
+			// timeout or the end of output, the rest is up to the user
+			return nil
+		}
+		prompt := prompts[idx]
+		if prompt.Max > 0 && answered[idx] >= prompt.Max {
+			return &promptError{strings.TrimSpace(match[0])}
+		}
+		answered[idx]++
+		answer, err := prompt.Answer(c, match)
+		if err != nil {
+			return err
+		}
+		if err := e.SendLine(answer); err != nil {
+			return err
 		}
 	}
-	return child.InteractTimeout(interactTimeoutSec * time.Second)
+}
+
+// tailBuffer keeps the last max bytes written
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) Bytes() []byte {
+	return b.buf
 }
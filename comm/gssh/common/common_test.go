@@ -1,9 +1,13 @@
 package common
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	sshconf "github.com/dorzheh/infra/comm/common"
 )
@@ -21,9 +25,162 @@ func TestRun(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	cmd := fmt.Sprintf("%s -r %s@%s:/etc/hosts /tmp", scp, conf.User, conf.Host)
+	if err := c.RunArgs(scp, "-r", conf.User+"@"+conf.Host+":/etc/hosts", "/tmp"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// prompting runs the shell script as the child
+func prompting(t *testing.T, c *Client, script string) error {
+	t.Helper()
+	if c.ExpectTimeout == 0 {
+		c.ExpectTimeout = 2 * time.Second
+	}
+	return c.RunArgs("/bin/sh", "-c", script)
+}
+
+const loginScript = `printf "user@host's password: "; read p
+if [ "$p" = secret ]; then echo ok; else echo "user@host: Permission denied (password)."; exit 255; fi`
+
+func TestPrompts(t *testing.T) {
+	c := NewClient(&sshconf.Config{Password: "secret"})
+	if err := prompting(t, c, loginScript); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewClient(&sshconf.Config{Password: "wrong"})
+	err := prompting(t, c, loginScript)
+	var e *Error
+	if !errors.As(err, &e) || !errors.Is(err, ErrPermissionDenied) || e.ExitCode() != 255 {
+		t.Fatalf("expected permission denied with exit status 255, got %v", err)
+	}
+
+	// the password is rejected by asking again
+	err = prompting(t, c, `printf "password: "; read p; printf "password: "; read p`)
+	if !errors.Is(err, ErrPromptRepeated) {
+		t.Fatalf("expected ErrPromptRepeated, got %v", err)
+	}
+
+	c = NewClient(&sshconf.Config{
+		Credentials: sshconf.CredentialFunc(func(req *sshconf.CredentialRequest) (string, error) {
+			if req.Kind != sshconf.CredentialPassphrase || req.KeyFile != "/keys/id" {
+				return "", fmt.Errorf("unexpected request %+v", req)
+			}
+			return "phrase", nil
+		}),
+	})
+	c.OTP = func(prompt string) (string, error) {
+		return "123456", nil
+	}
+	err = prompting(t, c, `printf "Enter passphrase for key '/keys/id': "; read p; [ "$p" = phrase ] || exit 1
+printf "Verification code: "; read p; [ "$p" = 123456 ] || exit 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostKeyPrompt(t *testing.T) {
+	script := `echo "ED25519 key fingerprint is SHA256:abc."
+printf "Are you sure you want to continue connecting (yes/no/[fingerprint])? "; read a; [ "$a" = yes ]`
+	for _, conf := range []*sshconf.Config{
+		{HostKeyPolicy: sshconf.HostKeyTOFU},
+		{HostKeyPolicy: sshconf.HostKeyInsecure},
+		{HostKeyPolicy: sshconf.HostKeyFingerprint, HostKeyFingerprint: "SHA256:abc"},
+	} {
+		if err := prompting(t, NewClient(conf), script); err != nil {
+			t.Errorf("policy %d: %v", conf.HostKeyPolicy, err)
+		}
+	}
+	for _, conf := range []*sshconf.Config{
+		{HostKeyPolicy: sshconf.HostKeyKnownHosts},
+		{HostKeyPolicy: sshconf.HostKeyFingerprint, HostKeyFingerprint: "SHA256:other"},
+	} {
+		err := prompting(t, NewClient(conf), script)
+		var e *Error
+		if !errors.As(err, &e) || !errors.Is(err, ErrHostKeyVerification) || e.ExitStatus != -1 {
+			t.Errorf("policy %d: expected host key verification failure, got %v", conf.HostKeyPolicy, err)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	err := prompting(t, NewClient(&sshconf.Config{}), "exit 3")
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != nil || e.ExitStatus != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestInteractTimeout(t *testing.T) {
+	c := NewClient(&sshconf.Config{})
+	c.ExpectTimeout = 100 * time.Millisecond
+	c.InteractTimeout = 300 * time.Millisecond
+	start := time.Now()
+	if err := c.RunArgs("sleep", "10"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the child was not killed")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	conf := &sshconf.Config{Host: "host", Password: "secret", Transcript: sshconf.NewTranscript()}
+	if err := prompting(t, NewClient(conf), loginScript); err != nil {
+		t.Fatal(err)
+	}
+	conf.Password = "wrong"
+	if err := prompting(t, NewClient(conf), loginScript); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	for _, e := range conf.Transcript.Entries() {
+		if strings.Contains(e.Stdout, "secret") {
+			t.Fatalf("the password is recorded: %q", e.Stdout)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := conf.Transcript.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := sshconf.ReadTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the script is not run, no password is needed
+	c := NewClient(&sshconf.Config{Host: "host", Transcript: replay})
+	if err := prompting(t, c, loginScript); err != nil {
+		t.Fatal(err)
+	}
+	var e *Error
+	if err := prompting(t, c, loginScript); !errors.As(err, &e) || !errors.Is(err, ErrPermissionDenied) || e.ExitStatus != 255 {
+		t.Fatalf("expected permission denied with exit status 255, got %v", err)
+	}
+}
 
-	if err := c.Run(cmd, 0); err != nil {
+func TestRecordRedactsCredentials(t *testing.T) {
+	conf := &sshconf.Config{Host: "host", Transcript: sshconf.NewTranscript()}
+	conf.Credentials = sshconf.CredentialFunc(func(*sshconf.CredentialRequest) (string, error) {
+		return "resolved-secret", nil
+	})
+	// the terminal echoes the password
+	script := `printf "user@host's password: "; read p; echo "got $p"`
+	if err := prompting(t, NewClient(conf), script); err != nil {
 		t.Fatal(err)
 	}
+	entries := conf.Transcript.Entries()
+	if len(entries) != 1 || !strings.Contains(entries[0].Stdout, "got "+sshconf.Redacted) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var log bytes.Buffer
+	c := NewClient(&sshconf.Config{Host: "host", DryRun: &log})
+	if err := c.RunArgs("/bin/sh", "-c", "exit 1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "/bin/sh -c exit 1") {
+		t.Fatalf("got %q", log.String())
+	}
 }
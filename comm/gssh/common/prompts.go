@@ -0,0 +1,160 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+// Prompt is an entry of the prompt/response table
+type Prompt struct {
+	Pattern *regexp.Regexp
+	// returns the response for the match and its submatches
+	Answer func(c *Client, match []string) (string, error)
+	// answered at most Max times (unlimited if zero).
+	// Asking again (e.g. for a rejected password) fails with ErrPromptRepeated
+	Max int
+}
+
+// Static returns Prompt.Answer responding with s
+func Static(s string) func(c *Client, match []string) (string, error) {
+	return func(c *Client, match []string) (string, error) {
+		return s, nil
+	}
+}
+
+// DefaultPrompts answer the prompts of ssh, scp, sshfs and sudo.
+// The secrets are resolved from Config only when asked for.
+// Unknown host keys are accepted according to Config.HostKeyPolicy
+var DefaultPrompts = []*Prompt{
+	{
+		Pattern: regexp.MustCompile(`(?:key fingerprint is (\S+)\.\s[\s\S]*?)?Are you sure you want to continue connecting \(yes/no(?:/\[fingerprint\])?\)\?`),
+		Answer:  answerHostKey,
+		Max:     1,
+	},
+	{
+		Pattern: regexp.MustCompile(`Enter passphrase for key '([^']*)':`),
+		Answer: func(c *Client, match []string) (string, error) {
+			return c.ResolvePassphrase(match[1])
+		},
+		Max: 1,
+	},
+	{
+		Pattern: regexp.MustCompile(`\[sudo\] password for [^:]*:`),
+		Answer: func(c *Client, match []string) (string, error) {
+			return c.ResolvePassword()
+		},
+		Max: 1,
+	},
+	{
+		Pattern: regexp.MustCompile(`(?i)(verification code|one-time password|otp)[^:\n]*:`),
+		Answer: func(c *Client, match []string) (string, error) {
+			if c.OTP == nil {
+				return "", fmt.Errorf("no answer for %q", match[0])
+			}
+			return c.OTP(match[0])
+		},
+	},
+	{
+		Pattern: regexp.MustCompile(`(?i)password:`),
+		Answer: func(c *Client, match []string) (string, error) {
+			return c.ResolvePassword()
+		},
+		Max: 1,
+	},
+}
+
+// answerHostKey accepts the unknown host key according to
+// Config.HostKeyPolicy: TOFU and insecure policies accept any key,
+// the fingerprint policy accepts the pinned key only.
+// Otherwise fails with ErrHostKeyVerification
+func answerHostKey(c *Client, match []string) (string, error) {
+	if c.Config != nil {
+		switch c.HostKeyPolicy {
+		case common.HostKeyTOFU, common.HostKeyInsecure:
+			return "yes", nil
+		case common.HostKeyFingerprint:
+			if match[1] != "" && match[1] == c.HostKeyFingerprint {
+				return "yes", nil
+			}
+		}
+	}
+	msg := "unknown host key"
+	if match[1] != "" {
+		msg += " " + match[1]
+	}
+	return "", fmt.Errorf("%w: %s", ErrHostKeyVerification, msg)
+}
+
+var (
+	ErrPromptRepeated      = errors.New("prompt repeated")
+	ErrTimeout             = errors.New("timed out")
+	ErrPermissionDenied    = errors.New("permission denied")
+	ErrHostKeyChanged      = errors.New("remote host identification has changed")
+	ErrHostKeyVerification = errors.New("host key verification failed")
+	ErrConnectionRefused   = errors.New("connection refused")
+	ErrConnectTimeout      = errors.New("connection timed out")
+	ErrUnknownHost         = errors.New("could not resolve hostname")
+)
+
+// Failure classifies the output of the failed child
+type Failure struct {
+	Pattern *regexp.Regexp
+	Err     error
+}
+
+// DefaultFailures recognize the failures of ssh and its clients.
+// The first matching entry wins
+var DefaultFailures = []*Failure{
+	{regexp.MustCompile(`REMOTE HOST IDENTIFICATION HAS CHANGED`), ErrHostKeyChanged},
+	{regexp.MustCompile(`Host key verification failed`), ErrHostKeyVerification},
+	{regexp.MustCompile(`Permission denied \([^)]*\)`), ErrPermissionDenied},
+	{regexp.MustCompile(`Connection refused`), ErrConnectionRefused},
+	{regexp.MustCompile(`Connection timed out|Operation timed out`), ErrConnectTimeout},
+	{regexp.MustCompile(`Could not resolve hostname[^\r\n]*`), ErrUnknownHost},
+}
+
+// Error is returned when the child fails
+type Error struct {
+	// the command line of the child
+	Command string
+	// one of the Failure errors, ErrPromptRepeated or ErrTimeout.
+	// Nil if the failure is not recognized
+	Kind error
+	// the output matched the failure or the prompt repeated
+	Message string
+	// exit status of the child, -1 if it was killed
+	ExitStatus int
+}
+
+func (e *Error) Error() string {
+	msg := "command failed"
+	if e.Kind != nil {
+		msg = e.Kind.Error()
+	}
+	if e.Message != "" {
+		msg += fmt.Sprintf(" (%s)", e.Message)
+	}
+	return fmt.Sprintf("executing %s : %s [exit status %d]", e.Command, msg, e.ExitStatus)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// ExitCode returns exit status of the child
+func (e *Error) ExitCode() int {
+	return e.ExitStatus
+}
+
+// classify returns the first failure matching the output
+func classify(failures []*Failure, output []byte) (string, error) {
+	for _, f := range failures {
+		if m := f.Pattern.Find(output); m != nil {
+			return string(m), f.Err
+		}
+	}
+	return "", nil
+}
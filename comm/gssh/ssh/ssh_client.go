@@ -1,28 +1,42 @@
 package ssh
 
 import (
-	"fmt"
 	"os/exec"
+	"strings"
 
 	ssh "github.com/dorzheh/infra/comm/common"
 	"github.com/dorzheh/infra/comm/gssh/common"
+	"github.com/dorzheh/infra/utils/shellutils"
 )
 
+// Options are passed to ssh and scp
+type Options struct {
+	// private key file (defaults to Config.PrvtKeyFile)
+	IdentityFile string
+	// remote port (defaults to Config.Port)
+	Port string
+	// extra ssh options ("-o" arguments), e.g. "StrictHostKeyChecking=no"
+	SshOptions []string
+}
+
 type Client struct {
 	common *common.Client
+	// applied to every Download, Upload and Run
+	Options *Options
 }
 
 func NewClient(config *ssh.Config) *Client {
-	return &Client{common.NewClient(config)}
+	return &Client{common: common.NewClient(config), Options: &Options{}}
 }
 
+// Download copies remote path recursively to local.
+// The remote path is expanded by the remote shell on legacy (non-SFTP) scp
 func (c *Client) Download(remote, local string) error {
 	scp, err := exec.LookPath("scp")
 	if err != nil {
 		return err
 	}
-	cmd := fmt.Sprintf("%s -P %s -r %s@%s:%s %s", scp, c.common.Port, c.common.User, c.common.Host, remote, local)
-	return c.common.Run(cmd, 0)
+	return c.common.RunArgs(scp, c.scpArgs(c.remotePath(remote), local)...)
 }
 
 func (c *Client) Upload(local, remote string) error {
@@ -30,15 +44,77 @@ func (c *Client) Upload(local, remote string) error {
 	if err != nil {
 		return err
 	}
-	cmd := fmt.Sprintf("%s -P %s -r  %s %s@%s:%s", scp, c.common.Port, local, c.common.User, c.common.Host, remote)
-	return c.common.Run(cmd, 100)
+	return c.common.RunArgs(scp, c.scpArgs(local, c.remotePath(remote))...)
 }
 
+// Run runs the command line by the remote shell
 func (c *Client) Run(cmd string) error {
 	ssh, err := exec.LookPath("ssh")
 	if err != nil {
 		return err
 	}
-	cmnd := fmt.Sprintf("%s -p %s %s@%s %s", ssh, c.common.Port, c.common.User, c.common.Host, cmd)
-	return c.common.Run(cmnd, 0)
+	return c.common.RunArgs(ssh, c.sshArgs(cmd)...)
+}
+
+// RunArgs runs the program with the arguments on the remote host.
+// The arguments are quoted for the remote shell
+func (c *Client) RunArgs(name string, args ...string) error {
+	return c.Run(shellutils.Join(append([]string{name}, args...)...))
+}
+
+// commonArgs returns the options understood by both ssh and scp
+func (c *Client) commonArgs() []string {
+	var args []string
+	identity := c.common.PrvtKeyFile
+	if c.Options != nil && c.Options.IdentityFile != "" {
+		identity = c.Options.IdentityFile
+	}
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	if c.Options != nil {
+		for _, o := range c.Options.SshOptions {
+			args = append(args, "-o", o)
+		}
+	}
+	return args
+}
+
+func (c *Client) port() string {
+	if c.Options != nil && c.Options.Port != "" {
+		return c.Options.Port
+	}
+	return c.common.Port
+}
+
+func (c *Client) sshArgs(cmd string) []string {
+	args := c.commonArgs()
+	if port := c.port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	if c.common.User != "" {
+		args = append(args, "-l", c.common.User)
+	}
+	// "--" keeps the host and the command from being taken as options
+	return append(args, "--", c.common.Host, cmd)
+}
+
+func (c *Client) scpArgs(src, dst string) []string {
+	args := append([]string{"-r"}, c.commonArgs()...)
+	if port := c.port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	return append(args, "--", src, dst)
+}
+
+// remotePath returns [user@]host:path, IPv6 addresses are bracketed
+func (c *Client) remotePath(path string) string {
+	host := c.common.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if c.common.User != "" {
+		host = c.common.User + "@" + host
+	}
+	return host + ":" + path
 }
@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/dorzheh/infra/comm/common"
@@ -22,3 +23,18 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestArgs(t *testing.T) {
+	c := NewClient(&common.Config{Host: "::1", Port: "2222", User: "user", PrvtKeyFile: "/keys/id rsa"})
+	c.Options.SshOptions = []string{"StrictHostKeyChecking=no"}
+	want := []string{"-i", "/keys/id rsa", "-o", "StrictHostKeyChecking=no", "-p", "2222", "-l", "user", "--", "::1", "ls  /tmp"}
+	if got := c.sshArgs("ls  /tmp"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ssh args %q, want %q", got, want)
+	}
+	c.Options.Port = "22"
+	c.Options.IdentityFile = "/keys/other"
+	want = []string{"-r", "-i", "/keys/other", "-o", "StrictHostKeyChecking=no", "-P", "22", "--", "/my file", "user@[::1]:/tmp/my file"}
+	if got := c.scpArgs("/my file", c.remotePath("/tmp/my file")); !reflect.DeepEqual(got, want) {
+		t.Errorf("scp args %q, want %q", got, want)
+	}
+}
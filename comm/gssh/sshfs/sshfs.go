@@ -1,17 +1,23 @@
 package sshfs
 
 import (
-	"fmt"
+	"context"
 	"os/exec"
 
 	ssh "github.com/dorzheh/infra/comm/common"
 	"github.com/dorzheh/infra/comm/gssh/common"
+	"github.com/dorzheh/infra/comm/remotefs"
+	fuse "github.com/dorzheh/infra/comm/sshfs"
 )
 
 type Config struct {
 	Common      *ssh.Config
 	SshfsPath   string
 	FusrmntPath string
+	// detected along with FusrmntPath if not set
+	FuseVersion fuse.FuseVersion
+	// fuse.DefaultOptions if nil
+	Options *fuse.Options
 }
 
 type Client struct {
@@ -28,24 +34,56 @@ func NewClient(config *Config) (*Client, error) {
 			return nil, err
 		}
 	}
-	if config.FusrmntPath == "" {
-		config.FusrmntPath, err = exec.LookPath("fusermount")
+	if config.FusrmntPath == "" || config.FuseVersion == 0 {
+		version, fusermount, err := fuse.DetectFuse()
 		if err != nil {
 			return nil, err
 		}
+		if config.FusrmntPath == "" {
+			config.FusrmntPath = fusermount
+		}
+		if config.FuseVersion == 0 {
+			config.FuseVersion = version
+		}
+	}
+	if config.Options == nil {
+		config.Options = fuse.DefaultOptions()
 	}
 	return &Client{config, common.NewClient(config.Common)}, nil
 }
 
+// Attach mounts the remote share answering the password prompt of sshfs
+// and waits for the mount to be live.
+// Nothing is done if the share is already mounted there.
+// Transient failures are retried by Common.Retry
 func (c *Client) Attach(remoteShare, localMount string) error {
-	cmd := fmt.Sprintf("%s %s@%s:%s %s -o port=%s,idmap=user,compression=no,nonempty,Ciphers=arcfour",
-		c.SshfsPath, c.User, c.Host, remoteShare, localMount, c.Port)
-	if c.PrvtKeyFile != "" {
-		cmd += ",IdentityFile=" + c.PrvtKeyFile
+	remote := fuse.RemoteSpec(c.User, c.Host, remoteShare)
+	if c.DryRun != nil {
+		ssh.LogDryRun(c.DryRun, c.Common.String(), "attach", remote, localMount)
+		return nil
 	}
-	return c.Run(cmd, 0)
+	return c.Common.Retry.Do(context.Background(), func(context.Context) error {
+		return fuse.AttachMount(remote, localMount, c.FusrmntPath, func(mountpoint string) error {
+			return c.RunArgs(c.SshfsPath, "-o", c.Options.MountOption(c.FuseVersion, c.Common), remote, mountpoint)
+		})
+	})
 }
 
+// Detach unmounts the share.Nothing is done if it is not mounted
 func (c *Client) Detach(localMount string) error {
-	return exec.Command(c.FusrmntPath, "-u", localMount).Run()
+	return c.DetachWith(localMount, fuse.DetachNormal)
+}
+
+// DetachWith unmounts the share lazily or forcibly
+func (c *Client) DetachWith(localMount string, mode fuse.DetachMode) error {
+	if c.DryRun != nil {
+		ssh.LogDryRun(c.DryRun, c.Common.String(), "detach", localMount)
+		return nil
+	}
+	return fuse.DetachMount(localMount, c.FusrmntPath, mode)
+}
+
+// FS returns the share mounted at localMount by Attach
+func (c *Client) FS(localMount string) remotefs.FS {
+	return remotefs.Dir(localMount)
 }
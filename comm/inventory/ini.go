@@ -0,0 +1,136 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parseINI parses Ansible-like INI inventory.
+// Hosts listed before the first section are ungrouped,
+// "[group:vars]" sections hold group defaults ("[all:vars]" global ones)
+func parseINI(data []byte) (*rawInventory, error) {
+	raw := &rawInventory{
+		Defaults:  make(map[string]string),
+		GroupDefs: make(map[string]*rawGroup),
+	}
+	group := func(name string) *rawGroup {
+		g, ok := raw.GroupDefs[name]
+		if !ok {
+			g = &rawGroup{Defaults: make(map[string]string)}
+			raw.GroupDefs[name] = g
+			raw.Groups = append(raw.Groups, name)
+		}
+		return g
+	}
+	// current section
+	var section string
+	var vars bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad section %q", n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			vars = false
+			if strings.HasSuffix(section, ":vars") {
+				section = strings.TrimSuffix(section, ":vars")
+				vars = true
+			} else if strings.Contains(section, ":") {
+				return nil, fmt.Errorf("line %d: unsupported section %q", n, line)
+			}
+			if section != "all" && section != "ungrouped" {
+				group(section)
+			}
+			continue
+		}
+		if vars {
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value", n)
+			}
+			k, v = strings.TrimSpace(k), unquote(strings.TrimSpace(v))
+			if section == "all" {
+				raw.Defaults[k] = v
+			} else {
+				group(section).Defaults[k] = v
+			}
+			continue
+		}
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		h := rawHost{Name: fields[0], Settings: make(map[string]string)}
+		for _, field := range fields[1:] {
+			k, v, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value, got %q", n, field)
+			}
+			h.Settings[k] = v
+		}
+		if section == "" || section == "all" || section == "ungrouped" {
+			raw.Hosts = append(raw.Hosts, h)
+		} else {
+			g := group(section)
+			g.Hosts = append(g.Hosts, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// splitFields splits the line by white space keeping quoted values
+// (key="a b") together
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				field.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
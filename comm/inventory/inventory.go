@@ -0,0 +1,479 @@
+// Package inventory loads hosts and their connection settings
+// from inventory files and OpenSSH client configuration
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dorzheh/infra/comm/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Format of inventory file
+type Format int
+
+const (
+	YAML Format = iota
+	JSON
+	// Ansible-like INI
+	INI
+)
+
+// settings recognized as connection parameters.
+// The rest of the settings become host variables
+var settingAliases = map[string]string{
+	"host":                         "host",
+	"hostname":                     "host",
+	"ansible_host":                 "host",
+	"port":                         "port",
+	"ansible_port":                 "port",
+	"user":                         "user",
+	"ansible_user":                 "user",
+	"password":                     "password",
+	"ansible_password":             "password",
+	"key":                          "key",
+	"identity_file":                "key",
+	"ansible_ssh_private_key_file": "key",
+	"passphrase":                   "passphrase",
+	"proxy_jump":                   "proxy_jump",
+}
+
+// Host is a single inventory host
+type Host struct {
+	Name string
+	// groups the host belongs to, in order of definition
+	Groups []string
+	// settings other than connection parameters
+	Vars   map[string]string
+	Config *common.Config
+}
+
+// Inventory holds hosts and groups
+type Inventory struct {
+	// hosts ordered by name
+	Hosts  []*Host
+	groups map[string][]*Host
+	byName map[string]*Host
+}
+
+// rawGroup is a group as defined in inventory file
+type rawGroup struct {
+	Defaults map[string]string
+	Hosts    []rawHost
+}
+
+type rawHost struct {
+	Name     string
+	Settings map[string]string
+}
+
+// rawInventory is the parsed file before settings are resolved
+type rawInventory struct {
+	Defaults map[string]string
+	// groups in order of definition
+	Groups    []string
+	GroupDefs map[string]*rawGroup
+	// ungrouped hosts
+	Hosts []rawHost
+}
+
+// Load reads inventory file.
+// The format is chosen by file extension: ".yaml", ".yml", ".json"
+// or INI otherwise
+func Load(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := INI
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = YAML
+	case ".json":
+		format = JSON
+	}
+	inv, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return inv, nil
+}
+
+// Parse parses inventory in the given format.
+//
+// YAML and JSON inventories look like
+//
+//	defaults:
+//	  user: root
+//	groups:
+//	  web:
+//	    defaults:
+//	      user: admin
+//	      key: ~/.ssh/web
+//	      env: prod
+//	    hosts:
+//	      web1:
+//	        host: 10.0.0.1
+//	        port: 2222
+//	      web2:
+//	hosts:
+//	  db1:
+//	    host: 10.0.0.5
+//	    proxy_jump: web1
+//
+// INI inventories look like
+//
+//	[all:vars]
+//	user=root
+//
+//	[web]
+//	web1 host=10.0.0.1 port=2222
+//	web2
+//
+//	[web:vars]
+//	user=admin
+//
+// Host settings override defaults of its groups which override global
+// defaults.Settings "host", "port", "user", "password", "key",
+// "passphrase" and "proxy_jump" (as well as their Ansible names) are
+// connection parameters, the rest are host variables.
+// proxy_jump is a comma separated list of inventory host names or
+// [user@]host[:port] addresses
+func Parse(data []byte, format Format) (*Inventory, error) {
+	var raw *rawInventory
+	var err error
+	switch format {
+	case YAML:
+		raw, err = parseYAML(data)
+	case JSON:
+		raw, err = parseJSON(data)
+	case INI:
+		raw, err = parseINI(data)
+	default:
+		err = fmt.Errorf("unknown inventory format %d", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return raw.resolve()
+}
+
+// fileInventory is the YAML and JSON schema
+type fileInventory struct {
+	Defaults map[string]interface{}            `yaml:"defaults" json:"defaults"`
+	Groups   map[string]*fileGroup             `yaml:"groups" json:"groups"`
+	Hosts    map[string]map[string]interface{} `yaml:"hosts" json:"hosts"`
+}
+
+type fileGroup struct {
+	Defaults map[string]interface{}            `yaml:"defaults" json:"defaults"`
+	Hosts    map[string]map[string]interface{} `yaml:"hosts" json:"hosts"`
+}
+
+func parseYAML(data []byte) (*rawInventory, error) {
+	var f fileInventory
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return f.raw(), nil
+}
+
+func parseJSON(data []byte) (*rawInventory, error) {
+	var f fileInventory
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	return f.raw(), nil
+}
+
+func (f *fileInventory) raw() *rawInventory {
+	raw := &rawInventory{
+		Defaults:  stringMap(f.Defaults),
+		GroupDefs: make(map[string]*rawGroup),
+		Hosts:     rawHosts(f.Hosts),
+	}
+	var groups []string
+	for name := range f.Groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		g := f.Groups[name]
+		if g == nil {
+			g = &fileGroup{}
+		}
+		raw.Groups = append(raw.Groups, name)
+		raw.GroupDefs[name] = &rawGroup{Defaults: stringMap(g.Defaults), Hosts: rawHosts(g.Hosts)}
+	}
+	return raw
+}
+
+func rawHosts(hosts map[string]map[string]interface{}) []rawHost {
+	var names []string
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var raw []rawHost
+	for _, name := range names {
+		raw = append(raw, rawHost{Name: name, Settings: stringMap(hosts[name])})
+	}
+	return raw
+}
+
+func stringMap(m map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(m))
+	for k, v := range m {
+		if v != nil {
+			s[k] = fmt.Sprint(v)
+		}
+	}
+	return s
+}
+
+// resolve merges the settings of every host
+func (raw *rawInventory) resolve() (*Inventory, error) {
+	type hostDef struct {
+		groups []string
+		// defaults of the groups and own settings of the host
+		groupSettings, hostSettings map[string]string
+	}
+	defs := make(map[string]*hostDef)
+	define := func(h rawHost, group string, defaults map[string]string) {
+		def, ok := defs[h.Name]
+		if !ok {
+			def = &hostDef{groupSettings: make(map[string]string), hostSettings: make(map[string]string)}
+			defs[h.Name] = def
+		}
+		if group != "" {
+			def.groups = append(def.groups, group)
+		}
+		for k, v := range defaults {
+			def.groupSettings[k] = v
+		}
+		for k, v := range h.Settings {
+			def.hostSettings[k] = v
+		}
+	}
+	for _, h := range raw.Hosts {
+		define(h, "", nil)
+	}
+	for _, name := range raw.Groups {
+		g := raw.GroupDefs[name]
+		for _, h := range g.Hosts {
+			define(h, name, g.Defaults)
+		}
+	}
+
+	inv := &Inventory{groups: make(map[string][]*Host), byName: make(map[string]*Host)}
+	settings := make(map[string]map[string]string)
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def := defs[name]
+		h := &Host{Name: name, Groups: def.groups, Vars: make(map[string]string)}
+		conn := make(map[string]string)
+		for _, settings := range []map[string]string{raw.Defaults, def.groupSettings, def.hostSettings} {
+			for k, v := range settings {
+				if setting, ok := settingAliases[strings.ToLower(k)]; ok {
+					conn[setting] = v
+				} else {
+					h.Vars[k] = v
+				}
+			}
+		}
+		settings[name] = conn
+		inv.Hosts = append(inv.Hosts, h)
+		inv.byName[name] = h
+		for _, g := range def.groups {
+			inv.groups[g] = append(inv.groups[g], h)
+		}
+	}
+	for _, name := range raw.Groups {
+		if _, ok := inv.groups[name]; !ok {
+			inv.groups[name] = nil
+		}
+	}
+
+	r := &resolver{settings: settings, configs: make(map[string]*common.Config), resolving: make(map[string]bool)}
+	for _, h := range inv.Hosts {
+		c, err := r.config(h.Name)
+		if err != nil {
+			return nil, err
+		}
+		h.Config = c
+	}
+	return inv, nil
+}
+
+// resolver builds configs resolving jump hosts by inventory names
+type resolver struct {
+	settings  map[string]map[string]string
+	configs   map[string]*common.Config
+	resolving map[string]bool
+}
+
+func (r *resolver) config(name string) (*common.Config, error) {
+	if c, ok := r.configs[name]; ok {
+		return c, nil
+	}
+	if r.resolving[name] {
+		return nil, fmt.Errorf("host %s: proxy_jump loop", name)
+	}
+	r.resolving[name] = true
+	defer delete(r.resolving, name)
+
+	s := r.settings[name]
+	c := &common.Config{
+		Host:        s["host"],
+		Port:        s["port"],
+		User:        s["user"],
+		Password:    s["password"],
+		PrvtKeyFile: expandHome(s["key"]),
+		Passphrase:  s["passphrase"],
+	}
+	if c.Host == "" {
+		c.Host = name
+	}
+	if c.Port == "" {
+		c.Port = "22"
+	}
+	if jumps := s["proxy_jump"]; jumps != "" && jumps != "none" {
+		for _, jump := range strings.Split(jumps, ",") {
+			jump = strings.TrimSpace(jump)
+			var hop *common.Config
+			if _, ok := r.settings[jump]; ok {
+				jc, err := r.config(jump)
+				if err != nil {
+					return nil, err
+				}
+				// jump hosts of the hop go first
+				c.JumpHosts = append(c.JumpHosts, jc.JumpHosts...)
+				hop = withoutJumps(jc)
+			} else {
+				// credentials of the host are used for the hop
+				hop = parseJump(jump, c)
+			}
+			c.JumpHosts = append(c.JumpHosts, hop)
+		}
+	}
+	r.configs[name] = c
+	return c, nil
+}
+
+func withoutJumps(c *common.Config) *common.Config {
+	hop := *c
+	hop.JumpHosts = nil
+	return &hop
+}
+
+// parseJump parses [user@]host[:port] address of a jump host
+func parseJump(jump string, base *common.Config) *common.Config {
+	hop := &common.Config{
+		User:        base.User,
+		Password:    base.Password,
+		PrvtKeyFile: base.PrvtKeyFile,
+		Passphrase:  base.Passphrase,
+		Credentials: base.Credentials,
+		Port:        "22",
+	}
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		hop.User, jump = jump[:i], jump[i+1:]
+	}
+	hop.Host = jump
+	if host, port, err := net.SplitHostPort(jump); err == nil {
+		hop.Host, hop.Port = host, port
+	}
+	return hop
+}
+
+// Host returns the host by name
+func (inv *Inventory) Host(name string) (*Host, bool) {
+	h, ok := inv.byName[name]
+	return h, ok
+}
+
+// Group returns hosts of the group."all" matches all the hosts
+func (inv *Inventory) Group(name string) ([]*Host, bool) {
+	if name == "all" {
+		return inv.Hosts, true
+	}
+	hosts, ok := inv.groups[name]
+	return hosts, ok
+}
+
+// Groups returns names of all the groups
+func (inv *Inventory) Groups() []string {
+	var names []string
+	for name := range inv.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select returns hosts matching any of the patterns.
+// A pattern is a host name, a group name or "all".
+// Every host is returned once, in order of the patterns
+func (inv *Inventory) Select(patterns ...string) ([]*Host, error) {
+	var hosts []*Host
+	seen := make(map[*Host]bool)
+	add := func(h *Host) {
+		if !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	for _, pattern := range patterns {
+		if h, ok := inv.Host(pattern); ok {
+			add(h)
+			continue
+		}
+		group, ok := inv.Group(pattern)
+		if !ok {
+			return nil, fmt.Errorf("no host or group %q in inventory", pattern)
+		}
+		for _, h := range group {
+			add(h)
+		}
+	}
+	return hosts, nil
+}
+
+// Configs is like Select but returns connection configs of the hosts
+func (inv *Inventory) Configs(patterns ...string) ([]*common.Config, error) {
+	hosts, err := inv.Select(patterns...)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]*common.Config, len(hosts))
+	for i, h := range hosts {
+		configs[i] = h.Config
+	}
+	return configs, nil
+}
+
+// expandHome replaces leading "~" by home directory of the user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
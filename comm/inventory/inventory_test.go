@@ -0,0 +1,164 @@
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const yamlInventory = `
+defaults:
+  user: root
+  key: /keys/default
+groups:
+  web:
+    defaults:
+      user: admin
+      env: prod
+    hosts:
+      web1:
+        host: 10.0.0.1
+        port: 2222
+        role: primary
+      web2:
+  db:
+    hosts:
+      db1:
+        host: 10.0.0.5
+        proxy_jump: web1, jumper@bastion.example.com:2200
+`
+
+const jsonInventory = `{
+  "defaults": {"user": "root", "key": "/keys/default"},
+  "groups": {
+    "web": {
+      "defaults": {"user": "admin", "env": "prod"},
+      "hosts": {
+        "web1": {"host": "10.0.0.1", "port": 2222, "role": "primary"},
+        "web2": null
+      }
+    },
+    "db": {
+      "hosts": {
+        "db1": {"host": "10.0.0.5", "proxy_jump": "web1, jumper@bastion.example.com:2200"}
+      }
+    }
+  }
+}`
+
+const iniInventory = `
+# comment
+[all:vars]
+user=root
+key=/keys/default
+
+[web]
+web1 ansible_host=10.0.0.1 ansible_port=2222 role="primary"
+web2
+
+[web:vars]
+user=admin
+env = prod
+
+[db]
+db1 host=10.0.0.5 proxy_jump="web1, jumper@bastion.example.com:2200"
+`
+
+func TestParse(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data   string
+		format Format
+	}{
+		"yaml": {yamlInventory, YAML},
+		"json": {jsonInventory, JSON},
+		"ini":  {iniInventory, INI},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inv, err := Parse([]byte(tc.data), tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInventory(t, inv)
+		})
+	}
+}
+
+func checkInventory(t *testing.T, inv *Inventory) {
+	if len(inv.Hosts) != 3 {
+		t.Fatalf("expected 3 hosts, got %d", len(inv.Hosts))
+	}
+	web1, ok := inv.Host("web1")
+	if !ok {
+		t.Fatal("web1 is missing")
+	}
+	c := web1.Config
+	if c.Host != "10.0.0.1" || c.Port != "2222" || c.User != "admin" || c.PrvtKeyFile != "/keys/default" {
+		t.Errorf("unexpected web1 config %+v", c)
+	}
+	if web1.Vars["env"] != "prod" || web1.Vars["role"] != "primary" || len(web1.Vars) != 2 {
+		t.Errorf("unexpected web1 vars %v", web1.Vars)
+	}
+	web2, _ := inv.Host("web2")
+	if web2.Config.Host != "web2" || web2.Config.Port != "22" {
+		t.Errorf("unexpected web2 config %+v", web2.Config)
+	}
+
+	db1, _ := inv.Host("db1")
+	c = db1.Config
+	if c.User != "root" || len(c.JumpHosts) != 2 {
+		t.Fatalf("unexpected db1 config %+v", c)
+	}
+	if hop := c.JumpHosts[0]; hop.Host != "10.0.0.1" || hop.User != "admin" || hop.Port != "2222" {
+		t.Errorf("unexpected first hop %+v", hop)
+	}
+	if hop := c.JumpHosts[1]; hop.Host != "bastion.example.com" || hop.User != "jumper" || hop.Port != "2200" || hop.PrvtKeyFile != "/keys/default" {
+		t.Errorf("unexpected second hop %+v", hop)
+	}
+
+	configs, err := inv.Configs("db1", "web", "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 3 || configs[0] != db1.Config {
+		t.Errorf("unexpected selection %v", configs)
+	}
+	if _, err := inv.Configs("nothing"); err == nil {
+		t.Error("expected error for unknown pattern")
+	}
+	if hosts, _ := inv.Group("all"); len(hosts) != 3 {
+		t.Errorf("unexpected hosts of all %v", hosts)
+	}
+}
+
+func TestProxyJumpLoop(t *testing.T) {
+	_, err := Parse([]byte(`
+hosts:
+  a:
+    proxy_jump: b
+  b:
+    proxy_jump: a
+`), YAML)
+	if err == nil {
+		t.Error("expected loop error")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"hosts.yml": yamlInventory, "hosts.json": jsonInventory, "hosts": iniInventory} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inv, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkInventory(t, inv)
+	}
+}
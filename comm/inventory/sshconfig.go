@@ -0,0 +1,386 @@
+package inventory
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+// max nesting of Include directives and ProxyJump chains
+const maxSSHConfigDepth = 16
+
+// SSHConfig is OpenSSH client configuration (ssh_config(5)).
+// Host and "Match all" blocks as well as Include directives are supported,
+// other Match blocks are ignored
+type SSHConfig struct {
+	blocks []*sshBlock
+}
+
+type sshBlock struct {
+	// host patterns, negated ones start with "!".Empty for options
+	// preceding the first Host block
+	patterns []string
+	// never matches (unsupported Match criteria)
+	never   bool
+	options []sshOption
+}
+
+type sshOption struct {
+	// lower case keyword
+	key   string
+	value string
+}
+
+// DefaultSSHConfigFile returns path to ~/.ssh/config
+func DefaultSSHConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// LoadSSHConfig reads OpenSSH client configuration file
+// (DefaultSSHConfigFile if path is empty)
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	if path == "" {
+		path = DefaultSSHConfigFile()
+	}
+	c := &SSHConfig{blocks: []*sshBlock{{}}}
+	if err := c.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseSSHConfig parses OpenSSH client configuration.
+// Relative Include paths are looked up in ~/.ssh
+func ParseSSHConfig(r io.Reader) (*SSHConfig, error) {
+	c := &SSHConfig{blocks: []*sshBlock{{}}}
+	if err := c.parse(r, "", 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SSHConfig) parseFile(path string, depth int) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return c.parse(fd, path, depth)
+}
+
+func (c *SSHConfig) parse(r io.Reader, name string, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return errors.New("ssh config: too many nested includes")
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		key, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", name, n, err)
+		}
+		if key == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s line %d: missing argument for %s", name, n, key)
+		}
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, &sshBlock{patterns: args})
+		case "match":
+			block := &sshBlock{patterns: []string{"*"}}
+			if len(args) != 1 || strings.ToLower(args[0]) != "all" {
+				block.never = true
+			}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			for _, pattern := range args {
+				if err := c.include(pattern, depth); err != nil {
+					return fmt.Errorf("%s line %d: %s", name, n, err)
+				}
+			}
+		default:
+			block := c.blocks[len(c.blocks)-1]
+			block.options = append(block.options, sshOption{key, strings.Join(args, " ")})
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *SSHConfig) include(pattern string, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, ".ssh", pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := c.parseFile(file, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSSHConfigLine splits "Keyword arguments" or "Keyword=arguments".
+// Arguments may be quoted
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+	args, err := splitFields(rest)
+	return key, args, err
+}
+
+// Hosts returns the host aliases defined without wildcards
+func (c *SSHConfig) Hosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, b := range c.blocks {
+		for _, p := range b.patterns {
+			if !strings.ContainsAny(p, "*?!") && !seen[p] {
+				seen[p] = true
+				hosts = append(hosts, p)
+			}
+		}
+	}
+	return hosts
+}
+
+// Get returns the first value of the option for the host alias
+// as ssh does
+func (c *SSHConfig) Get(alias, key string) string {
+	if values := c.getAll(alias, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c *SSHConfig) getAll(alias, key string) []string {
+	key = strings.ToLower(key)
+	var values []string
+	for _, b := range c.blocks {
+		if !b.matches(alias) {
+			continue
+		}
+		for _, o := range b.options {
+			if o.key == key {
+				values = append(values, o.value)
+			}
+		}
+	}
+	return values
+}
+
+func (b *sshBlock) matches(alias string) bool {
+	if b.never {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+	alias = strings.ToLower(alias)
+	matched := false
+	for _, p := range b.patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "!") {
+			if wildcardMatch(p[1:], alias) {
+				return false
+			}
+		} else if wildcardMatch(p, alias) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches s against pattern with "*" and "?" wildcards
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// Config returns connection config of the host alias
+func (c *SSHConfig) Config(alias string) (*common.Config, error) {
+	return c.config(alias, 0)
+}
+
+func (c *SSHConfig) config(alias string, depth int) (*common.Config, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("ssh config: ProxyJump loop at %s", alias)
+	}
+	hostname := c.Get(alias, "hostname")
+	if hostname == "" {
+		hostname = alias
+	}
+	hostname = expandTokens(hostname, alias, "", "")
+	config := &common.Config{
+		Host:     hostname,
+		Port:     c.Get(alias, "port"),
+		User:     c.Get(alias, "user"),
+		UseAgent: c.Get(alias, "identityagent") != "none",
+	}
+	if config.Port == "" {
+		config.Port = "22"
+	}
+	if config.User == "" {
+		if u, err := user.Current(); err == nil {
+			config.User = u.Username
+		}
+	}
+	for i, key := range c.getAll(alias, "identityfile") {
+		key = expandTokens(key, hostname, config.User, config.Port)
+		if i == 0 {
+			config.PrvtKeyFile = key
+		} else {
+			config.PrvtKeyFiles = append(config.PrvtKeyFiles, key)
+		}
+	}
+	switch strings.ToLower(c.Get(alias, "stricthostkeychecking")) {
+	case "no", "off":
+		config.HostKeyPolicy = common.HostKeyInsecure
+	case "accept-new":
+		config.HostKeyPolicy = common.HostKeyTOFU
+	}
+	if files := strings.Fields(c.Get(alias, "userknownhostsfile")); len(files) > 0 && files[0] != "none" {
+		config.KnownHostsFile = expandTokens(files[0], hostname, config.User, config.Port)
+	}
+	var err error
+	if config.Timeout, err = seconds(c.Get(alias, "connecttimeout")); err != nil {
+		return nil, fmt.Errorf("ssh config: %s ConnectTimeout: %s", alias, err)
+	}
+	if config.KeepAliveInterval, err = seconds(c.Get(alias, "serveraliveinterval")); err != nil {
+		return nil, fmt.Errorf("ssh config: %s ServerAliveInterval: %s", alias, err)
+	}
+	if v := c.Get(alias, "serveralivecountmax"); v != "" {
+		if config.KeepAliveCountMax, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("ssh config: %s ServerAliveCountMax: %s", alias, err)
+		}
+	}
+
+	if jumps := c.Get(alias, "proxyjump"); jumps != "" && jumps != "none" {
+		for _, jump := range strings.Split(jumps, ",") {
+			hop, err := c.jumpConfig(strings.TrimSpace(jump), depth)
+			if err != nil {
+				return nil, err
+			}
+			config.JumpHosts = append(config.JumpHosts, hop.JumpHosts...)
+			config.JumpHosts = append(config.JumpHosts, withoutJumps(hop))
+		}
+	}
+	return config, nil
+}
+
+// jumpConfig resolves [user@]host[:port] (or ssh:// URI) of ProxyJump.
+// The host is looked up in the configuration as well
+func (c *SSHConfig) jumpConfig(jump string, depth int) (*common.Config, error) {
+	jump = strings.TrimPrefix(jump, "ssh://")
+	var jumpUser, port string
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		jumpUser, jump = jump[:i], jump[i+1:]
+	}
+	host := jump
+	if h, p, err := splitJumpHostPort(jump); err == nil {
+		host, port = h, p
+	}
+	hop, err := c.config(host, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if jumpUser != "" {
+		hop.User = jumpUser
+	}
+	if port != "" {
+		hop.Port = port
+	}
+	return hop, nil
+}
+
+func splitJumpHostPort(s string) (string, string, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 || strings.Count(s, ":") > 1 && !strings.HasPrefix(s, "[") {
+		return "", "", errors.New("no port")
+	}
+	return strings.Trim(s[:i], "[]"), s[i+1:], nil
+}
+
+func seconds(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// expandTokens expands "~" and the tokens %h (host), %r (remote user),
+// %p (port), %d (home directory), %u (local user) and %%
+func expandTokens(s, host, remoteUser, port string) string {
+	s = expandHome(s)
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	home, _ := os.UserHomeDir()
+	var local string
+	if u, err := user.Current(); err == nil {
+		local = u.Username
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%r", remoteUser,
+		"%p", port,
+		"%d", home,
+		"%u", local,
+	).Replace(s)
+}
@@ -0,0 +1,97 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+const sshConfig = `
+# global options apply to every host
+ConnectTimeout 10
+
+Host bastion
+    HostName bastion.example.com
+    User jumper
+    Port 2200
+
+Host web-* !web-test
+    User admin
+    IdentityFile ~/.ssh/web
+    ProxyJump bastion
+
+Host web-1
+    HostName 10.0.0.1
+    IdentityFile=/keys/%h-%r
+
+Host db
+    HostName %h.internal
+    ProxyJump web-1,root@other:23
+    StrictHostKeyChecking accept-new
+    ServerAliveInterval 5
+    ServerAliveCountMax 2
+
+Match exec "false"
+    User never
+
+Host *
+    User fallback
+    Port 22
+`
+
+func TestSSHConfig(t *testing.T) {
+	c, err := ParseSSHConfig(strings.NewReader(sshConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := c.Hosts(); strings.Join(hosts, ",") != "bastion,web-1,db" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+
+	web, err := c.Config("web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web.Host != "10.0.0.1" || web.User != "admin" || web.Port != "22" || web.Timeout != 10*time.Second {
+		t.Errorf("unexpected config %+v", web)
+	}
+	if !strings.HasSuffix(web.PrvtKeyFile, "/.ssh/web") || len(web.PrvtKeyFiles) != 1 || web.PrvtKeyFiles[0] != "/keys/10.0.0.1-admin" {
+		t.Errorf("unexpected keys %q %q", web.PrvtKeyFile, web.PrvtKeyFiles)
+	}
+	if len(web.JumpHosts) != 1 || web.JumpHosts[0].Host != "bastion.example.com" || web.JumpHosts[0].User != "jumper" || web.JumpHosts[0].Port != "2200" {
+		t.Errorf("unexpected jump hosts %+v", web.JumpHosts)
+	}
+
+	test, _ := c.Config("web-test")
+	if test.User != "fallback" || test.Host != "web-test" || len(test.JumpHosts) != 0 {
+		t.Errorf("negated pattern matched %+v", test)
+	}
+
+	db, err := c.Config("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Host != "db.internal" || db.HostKeyPolicy != common.HostKeyTOFU || db.KeepAliveInterval != 5*time.Second || db.KeepAliveCountMax != 2 {
+		t.Errorf("unexpected config %+v", db)
+	}
+	// jump hosts of the hops go first
+	var chain []string
+	for _, hop := range db.JumpHosts {
+		chain = append(chain, hop.User+"@"+hop.Host+":"+hop.Port)
+	}
+	if strings.Join(chain, " ") != "jumper@bastion.example.com:2200 admin@10.0.0.1:22 root@other:23" {
+		t.Errorf("unexpected chain %v", chain)
+	}
+}
+
+func TestSSHConfigLoop(t *testing.T) {
+	c, err := ParseSSHConfig(strings.NewReader("Host a\n ProxyJump b\nHost b\n ProxyJump a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Config("a"); err == nil {
+		t.Error("expected loop error")
+	}
+}
@@ -0,0 +1,234 @@
+// Package parallel runs commands and uploads on many hosts concurrently
+package parallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh"
+)
+
+// DefaultWorkers is used when Options.Workers is not set
+const DefaultWorkers = 10
+
+// ErrSkipped is set for hosts never started because of Options.FailFast
+var ErrSkipped = errors.New("skipped after failure of another host")
+
+type Options struct {
+	// max hosts processed concurrently (defaults to DefaultWorkers)
+	Workers int
+	// per host timeout including connecting (no timeout if zero)
+	Timeout time.Duration
+	// once any host fails, the running hosts are canceled and
+	// the rest are skipped
+	FailFast bool
+	// if set, connections are taken from the pool
+	// instead of dialing a new one for every host
+	Pool *ssh.Pool
+}
+
+// HostResult is the outcome of a single host
+type HostResult struct {
+	Config *common.Config
+	// nil for uploads and for hosts the command has not been started on
+	Result *common.Result
+	Err    error
+}
+
+// Host returns name of the host as it is shown in reports
+func (r *HostResult) Host() string {
+	return hostName(r.Config)
+}
+
+func hostName(c *common.Config) string {
+	if c.Port == "" || c.Port == "22" {
+		return c.Host
+	}
+	return net.JoinHostPort(c.Host, c.Port)
+}
+
+// Func does the job on a single host
+type Func func(ctx context.Context, conn *ssh.SshConn) (*common.Result, error)
+
+// Run runs cmd on all the hosts.
+// Results are returned in the order of configs
+func Run(ctx context.Context, configs []*common.Config, cmd string, opts *Options) Results {
+	return Do(ctx, configs, func(ctx context.Context, conn *ssh.SshConn) (*common.Result, error) {
+		return conn.ExecContext(ctx, cmd)
+	}, opts)
+}
+
+// Upload uploads local src to dst on all the hosts
+func Upload(ctx context.Context, configs []*common.Config, src, dst string, opts *Options) Results {
+	return Do(ctx, configs, func(ctx context.Context, conn *ssh.SshConn) (*common.Result, error) {
+		return nil, conn.UploadContext(ctx, src, dst)
+	}, opts)
+}
+
+// Do calls fn with connection to every host
+func Do(ctx context.Context, configs []*common.Config, fn Func, opts *Options) Results {
+	if opts == nil {
+		opts = &Options{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(Results, len(configs))
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		results[i] = &HostResult{Config: config}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			results[i].Err = ErrSkipped
+			if !opts.FailFast {
+				results[i].Err = ctx.Err()
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(r *HostResult) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			r.Result, r.Err = doHost(ctx, r.Config, fn, opts)
+			if r.Err != nil && opts.FailFast {
+				cancel()
+			}
+		}(results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func doHost(ctx context.Context, config *common.Config, fn Func, opts *Options) (*common.Result, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	var conn *ssh.SshConn
+	var err error
+	if opts.Pool != nil {
+		conn, err = opts.Pool.GetContext(ctx, config)
+	} else {
+		conn, err = ssh.NewSshConnContext(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Pool == nil {
+		defer conn.ConnClose()
+	}
+	return fn(ctx, conn)
+}
+
+// Results of all the hosts
+type Results []*HostResult
+
+// Failed returns results of the hosts failed (or skipped)
+func (rs Results) Failed() Results {
+	var failed Results
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Err returns nil if all the hosts succeeded and *Error otherwise
+func (rs Results) Err() error {
+	if failed := rs.Failed(); len(failed) > 0 {
+		return &Error{Failed: failed, Total: len(rs)}
+	}
+	return nil
+}
+
+// Error reports the hosts failed
+type Error struct {
+	Failed Results
+	Total  int
+}
+
+func (e *Error) Error() string {
+	hosts := make([]string, len(e.Failed))
+	for i, r := range e.Failed {
+		hosts[i] = r.Host()
+	}
+	return fmt.Sprintf("%d of %d hosts failed: %s", len(e.Failed), e.Total, strings.Join(hosts, ", "))
+}
+
+// Group collects the hosts produced identical result
+type Group struct {
+	Hosts      []string
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+	// error of the hosts the command did not complete on
+	Err string
+}
+
+// Aggregate groups the hosts by identical output, exit status and
+// error like pssh and clush do.
+// Errors are compared by their cause with the host address removed
+// Groups are ordered by the first host of each group
+func (rs Results) Aggregate() []*Group {
+	type groupKey struct {
+		stdout, stderr string
+		exitStatus     int
+		err            string
+	}
+	var groups []*Group
+	index := make(map[groupKey]*Group)
+	for _, r := range rs {
+		var key groupKey
+		if r.Result != nil {
+			key.stdout = r.Result.Stdout
+			key.stderr = r.Result.Stderr
+			key.exitStatus = r.Result.ExitStatus
+		}
+		var exitErr *common.ExitError
+		if r.Err != nil && !errors.As(r.Err, &exitErr) {
+			key.err = groupError(r)
+		}
+		g, ok := index[key]
+		if !ok {
+			g = &Group{Stdout: key.stdout, Stderr: key.stderr, ExitStatus: key.exitStatus, Err: key.err}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.Hosts = append(g.Hosts, r.Host())
+	}
+	return groups
+}
+
+// groupError returns the cause of the host error free of the host
+// specifics, so the same failure of different hosts is grouped
+func groupError(r *HostResult) string {
+	err := r.Err
+	for next := errors.Unwrap(err); next != nil; next = errors.Unwrap(err) {
+		err = next
+	}
+	// the cause may be unwrapped from the redacted error
+	msg := common.Redact(err.Error(), r.Config.Secrets()...)
+	if r.Config.Host == "" {
+		return msg
+	}
+	msg = strings.ReplaceAll(msg, net.JoinHostPort(r.Config.Host, r.Config.Port), "<host>")
+	return strings.ReplaceAll(msg, r.Config.Host, "<host>")
+}
@@ -0,0 +1,158 @@
+package parallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func servers(t *testing.T, n int) []*common.Config {
+	configs := make([]*common.Config, n)
+	for i := range configs {
+		configs[i] = sshtest.NewServer(t, nil).Config()
+	}
+	return configs
+}
+
+func TestRun(t *testing.T) {
+	configs := servers(t, 4)
+	// the same server reached under another name yields the same output
+	configs[3].Host = "localhost"
+	configs[3].Password = "wrong"
+
+	results := Run(context.Background(), configs, "echo hello", &Options{Workers: 2})
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	for _, r := range results[:3] {
+		if r.Err != nil || r.Result.Stdout != "hello\n" {
+			t.Errorf("%s: unexpected result %+v %v", r.Host(), r.Result, r.Err)
+		}
+	}
+	if results[3].Err == nil {
+		t.Error("expected authentication failure")
+	}
+	var perr *Error
+	if err := results.Err(); !errors.As(err, &perr) || len(perr.Failed) != 1 {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	groups := results.Aggregate()
+	if len(groups) != 2 || len(groups[0].Hosts) != 3 || groups[0].Stdout != "hello\n" || groups[1].Err == "" {
+		t.Errorf("unexpected groups %+v", groups)
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	var results Results
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		config := &common.Config{Host: host, Port: "22", Password: "secret"}
+		err := fmt.Errorf("%s: %w", host, &net.OpError{Op: "dial", Net: "tcp",
+			Addr: &net.TCPAddr{IP: net.ParseIP(host), Port: 22}, Err: syscall.ECONNREFUSED})
+		results = append(results, &HostResult{Config: config, Err: err})
+	}
+	config := &common.Config{Host: "10.0.0.3", Password: "secret"}
+	cause := errors.New("ssh: unable to authenticate as 10.0.0.3 with secret")
+	results = append(results, &HostResult{Config: config, Err: common.RedactError(cause, "secret")})
+
+	groups := results.Aggregate()
+	if len(groups) != 2 || len(groups[0].Hosts) != 2 || groups[0].Err != "connection refused" {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+	if groups[1].Err != "ssh: unable to authenticate as <host> with "+common.Redacted {
+		t.Errorf("unexpected error %q", groups[1].Err)
+	}
+}
+
+func TestRunExitStatus(t *testing.T) {
+	configs := servers(t, 2)
+	results := Run(context.Background(), configs, "echo out; exit 2", nil)
+	groups := results.Aggregate()
+	if len(groups) != 1 || groups[0].ExitStatus != 2 || groups[0].Err != "" || len(groups[0].Hosts) != 2 {
+		t.Errorf("unexpected groups %+v", groups)
+	}
+	if results.Err() == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	configs := servers(t, 1)
+	for i := 0; i < 5; i++ {
+		c := *configs[0]
+		configs = append(configs, &c)
+	}
+	var started int32
+	results := Do(context.Background(), configs, func(ctx context.Context, conn *ssh.SshConn) (*common.Result, error) {
+		if atomic.AddInt32(&started, 1) == 1 {
+			return nil, errors.New("failed")
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, &Options{Workers: 2, FailFast: true})
+
+	skipped := 0
+	for _, r := range results {
+		if r.Err == nil {
+			t.Errorf("%s: expected error", r.Host())
+		}
+		if r.Err == ErrSkipped {
+			skipped++
+		}
+	}
+	// hosts canceled while connecting are neither started nor skipped
+	if skipped == 0 || int(started)+skipped > len(configs) {
+		t.Errorf("started %d, skipped %d of %d", started, skipped, len(configs))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	configs := servers(t, 2)
+	start := time.Now()
+	results := Run(context.Background(), configs, "sleep 10", &Options{Timeout: 200 * time.Millisecond})
+	if time.Since(start) > 5*time.Second {
+		t.Error("timeout is not applied")
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got %v", r.Host(), r.Err)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	configs := servers(t, 2)
+	dir, err := ioutil.TempDir("", "parallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the servers share the local filesystem
+	for i, config := range configs {
+		dst := filepath.Join(dir, "dst", config.Port)
+		os.MkdirAll(filepath.Dir(dst), 0755)
+		results := Upload(context.Background(), configs[i:i+1], src, dst, nil)
+		if err := results.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "data" {
+			t.Errorf("unexpected upload %q %v", data, err)
+		}
+	}
+}
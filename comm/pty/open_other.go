@@ -0,0 +1,12 @@
+//go:build !linux
+
+package pty
+
+import (
+	"errors"
+	"os"
+)
+
+func open() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("pseudo-terminals are supported on Linux only")
+}
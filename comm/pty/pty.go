@@ -0,0 +1,213 @@
+// Package pty runs local commands attached to pseudo-terminals and
+// manages the local terminal of interactive sessions
+package pty
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/dorzheh/infra/comm/expect"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// Pty is the master side of a pseudo-terminal
+type Pty struct {
+	*os.File
+}
+
+// Read returns io.EOF once the slave side is closed by all the processes
+func (p *Pty) Read(b []byte) (int, error) {
+	n, err := p.File.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Resize sets the terminal size
+func (p *Pty) Resize(width, height int) error {
+	conn, err := p.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ws := &unix.Winsize{Col: uint16(width), Row: uint16(height)}
+	if cerr := conn.Control(func(fd uintptr) {
+		err = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, ws)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Start starts cmd in a new session with the pseudo-terminal as its
+// controlling terminal.Standard streams of cmd which are not set
+// are attached to the terminal.
+// The caller should close the returned Pty once cmd exits
+func Start(cmd *exec.Cmd) (*Pty, error) {
+	master, slave, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	if cmd.Stdin == nil {
+		cmd.Stdin = slave
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = slave
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = slave
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	if cmd.Stdin != slave {
+		// the controlling terminal is taken from the child stdin
+		cmd.ExtraFiles = append(cmd.ExtraFiles, slave)
+		cmd.SysProcAttr.Ctty = 3 + len(cmd.ExtraFiles) - 1
+	}
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return &Pty{master}, nil
+}
+
+// MakeRaw puts the terminal f into raw mode.
+// The returned function restores the previous mode.
+// Nothing is done if f is not a terminal
+func MakeRaw(f *os.File) (restore func() error, err error) {
+	fd := int(f.Fd())
+	if !term.IsTerminal(fd) {
+		return func() error { return nil }, nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return term.Restore(fd, state)
+	}, nil
+}
+
+// NotifyResize calls fn with the size of the terminal f right away
+// and every time it is changed (SIGWINCH).
+// Nothing is done if f is not a terminal.
+// The returned function stops the notifications
+func NotifyResize(f *os.File, fn func(width, height int) error) (stop func()) {
+	fd := int(f.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}
+	}
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGWINCH)
+	go func() {
+		for {
+			if width, height, err := term.GetSize(fd); err == nil {
+				fn(width, height)
+			}
+			select {
+			case <-sigs:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// Interact hands the session scripted by e over to the user of the
+// terminal stdin.The terminal is put into raw mode for the time of
+// interaction and its size changes are propagated by resize.
+// stdin is no longer read once Interact returns
+func Interact(e *expect.Expecter, stdin *os.File, stdout io.Writer, resize func(width, height int) error) error {
+	restore, err := MakeRaw(stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	stop := NotifyResize(stdin, resize)
+	defer stop()
+	in, err := newCancelReader(stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return e.Interact(in, stdout)
+}
+
+// cancelReader reads the file only once it is readable, so that
+// a pending Read can be interrupted by Cancel without consuming input
+type cancelReader struct {
+	fd int
+	// closing the write end wakes up the pending Read
+	cancelR, cancelW *os.File
+	once             sync.Once
+}
+
+func newCancelReader(f *os.File) (*cancelReader, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &cancelReader{fd: int(f.Fd()), cancelR: r, cancelW: w}, nil
+}
+
+// Read returns io.EOF once canceled
+func (c *cancelReader) Read(b []byte) (int, error) {
+	fds := []unix.PollFd{
+		{Fd: int32(c.fd), Events: unix.POLLIN},
+		{Fd: int32(c.cancelR.Fd()), Events: unix.POLLIN},
+	}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return 0, err
+		}
+		if fds[1].Revents != 0 {
+			return 0, io.EOF
+		}
+		if fds[0].Revents == 0 {
+			continue
+		}
+		n, err := unix.Read(c.fd, b)
+		switch {
+		case err == unix.EINTR || err == unix.EAGAIN:
+			continue
+		case err != nil:
+			return 0, err
+		case n == 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// Cancel interrupts the pending and further reads
+func (c *cancelReader) Cancel() {
+	c.once.Do(func() {
+		c.cancelW.Close()
+	})
+}
+
+// Close cancels the reader and releases its resources.
+// The file is left open
+func (c *cancelReader) Close() error {
+	c.Cancel()
+	return c.cancelR.Close()
+}
@@ -0,0 +1,76 @@
+package pty
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/expect"
+)
+
+func TestStart(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "tty; read x; stty size; echo $x")
+	p, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	e := expect.New(p, p)
+	if _, _, err := e.Expect(5*time.Second, regexp.MustCompile(`/dev/pts/\d+`)); err != nil {
+		t.Fatalf("%v, output %q", err, e.Buffered())
+	}
+	if err := p.Resize(100, 40); err != nil {
+		t.Fatal(err)
+	}
+	e.SendLine("done")
+	if err := e.ExpectString(5*time.Second, "40 100"); err != nil {
+		t.Fatalf("%v, output %q", err, e.Buffered())
+	}
+	if err := e.ExpectString(5*time.Second, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Wait(); err != nil {
+		t.Errorf("expected EOF once the command exits, got %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInteractStopsReading(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "read x; echo got $x")
+	p, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer input.Close()
+
+	io.WriteString(input, "first\n")
+	var stdout bytes.Buffer
+	if err := Interact(expect.New(p, p), stdin, &stdout, p.Resize); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "got first") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	cmd.Wait()
+
+	// the input following the interaction is left to the next reader
+	io.WriteString(input, "second\n")
+	buf := make([]byte, 64)
+	n, err := stdin.Read(buf)
+	if err != nil || string(buf[:n]) != "second\n" {
+		t.Fatalf("input is consumed after Interact: %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,138 @@
+// Package remotefs provides file system access to remote hosts without
+// mounting them: an io/fs read view plus write operations over SFTP.
+// Mounted shares (sshfs) are exposed by the same interface
+package remotefs
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FS is a writable file system.
+// Names are slash-separated and relative to the root of the file system
+// as io/fs requires ("." is the root itself)
+type FS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	fs.ReadFileFS
+
+	// OpenFile opens the file with the flags of os.OpenFile
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// Create creates or truncates the file for writing
+	Create(name string) (File, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// MkdirAll creates the directory along with any necessary parents
+	MkdirAll(name string, perm fs.FileMode) error
+	// Remove removes the file or empty directory
+	Remove(name string) error
+	// RemoveAll removes the path and any children it contains
+	RemoveAll(name string) error
+	// Rename renames the file replacing newname if exists
+	Rename(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// File is an open file of FS
+type File interface {
+	fs.File
+	io.Writer
+	io.Seeker
+}
+
+// Dir returns FS of the local directory, e.g. the mount point of
+// a share mounted by sshfs
+func Dir(root string) FS {
+	return &dirFS{root: root, FS: os.DirFS(root)}
+}
+
+type dirFS struct {
+	root string
+	fs.FS
+}
+
+// path validates name and converts it to the local path
+func (d *dirFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name)), nil
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(d.FS, name)
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(d.FS, name)
+}
+
+func (d *dirFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(d.FS, name)
+}
+
+func (d *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d *dirFS) Create(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (d *dirFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p, err := d.path("open", name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, perm)
+}
+
+func (d *dirFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (d *dirFS) Remove(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d *dirFS) RemoveAll(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (d *dirFS) Rename(oldname, newname string) error {
+	oldpath, err := d.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := d.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (d *dirFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := d.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
@@ -0,0 +1,101 @@
+package remotefs
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dorzheh/infra/comm/ssh"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+// testWritableFS populates fsys by the write operations and
+// then verifies it by fstest
+func testWritableFS(t *testing.T, fsys FS) {
+	if err := fsys.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFile("a/b/file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Create("a/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := fsys.Rename("a/other", "top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Chmod("top", 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fsys.Stat("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 4 || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected file info %d %s", info.Size(), info.Mode())
+	}
+	if data, err := fsys.ReadFile("top"); err != nil || string(data) != "other" {
+		t.Fatalf("ReadFile: %q %v", data, err)
+	}
+	if err := fstest.TestFS(fsys, "a/b/file", "top"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fsys.Stat("../escape"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	if _, err := fsys.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := fsys.RemoveAll("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("top"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := fsys.ReadDir("."); err != nil || len(entries) != 0 {
+		t.Fatalf("expected empty root, got %v %v", entries, err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "remotefstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// resolve symlinks of the temporary directory (e.g. macOS /tmp)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSFTP(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := ssh.NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+	fsys, err := SFTP(c, tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWritableFS(t, fsys)
+}
+
+func TestDir(t *testing.T) {
+	testWritableFS(t, Dir(tempDir(t)))
+}
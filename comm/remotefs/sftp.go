@@ -0,0 +1,280 @@
+package remotefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/dorzheh/infra/comm/ssh"
+	"github.com/pkg/sftp"
+)
+
+// SFTP returns FS of the remote directory root (home directory if empty)
+// served over SFTP by the connection.
+// The FS is valid until the connection is closed
+func SFTP(conn *ssh.SshConn, root string) (FS, error) {
+	client, err := conn.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		if root, err = client.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	return &sftpFS{client: client, root: root}, nil
+}
+
+type sftpFS struct {
+	client *sftp.Client
+	root   string
+}
+
+// path validates name and converts it to the remote path
+func (s *sftpFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(s.root, name), nil
+}
+
+// pathError reports err with name relative to the root
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (s *sftpFS) Open(name string) (fs.File, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.Stat(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if info.IsDir() {
+		return &sftpDir{fs: s, name: name, info: info}, nil
+	}
+	f, err := s.client.Open(p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+
+func (s *sftpFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.Stat(p)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir returns the directory entries sorted by name
+func (s *sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := s.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := s.client.ReadDir(p)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+func (s *sftpFS) ReadFile(name string) ([]byte, error) {
+	p, err := s.path("read", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.client.Open(p)
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	return data, nil
+}
+
+// OpenFile opens the file with the flags of os.OpenFile.
+// perm is applied to the files created
+func (s *sftpFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	if flag&os.O_CREATE != 0 {
+		_, err := s.client.Stat(p)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+	f, err := s.client.OpenFile(p, flag)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if created {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, pathError("chmod", name, err)
+		}
+	}
+	return f, nil
+}
+
+func (s *sftpFS) Create(name string) (File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (s *sftpFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := s.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return pathError("write", name, err)
+	}
+	return f.Close()
+}
+
+// MkdirAll creates the directory along with any necessary parents.
+// perm is applied to the directory if it is created
+func (s *sftpFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := s.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Stat(p)
+	exists := err == nil
+	// fails if exists and is not a directory
+	if err := s.client.MkdirAll(p); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	if exists {
+		return nil
+	}
+	if err := s.client.Chmod(p, perm); err != nil {
+		return pathError("chmod", name, err)
+	}
+	return nil
+}
+
+func (s *sftpFS) Remove(name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Remove(p); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+func (s *sftpFS) RemoveAll(name string) error {
+	p, err := s.path("remove", name)
+	if err != nil {
+		return err
+	}
+	if err := s.client.RemoveAll(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+func (s *sftpFS) Rename(oldname, newname string) error {
+	oldpath, err := s.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := s.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	if err := s.client.PosixRename(oldpath, newpath); err == nil {
+		return nil
+	}
+	// the server does not support posix-rename@openssh.com
+	if err := s.client.Rename(oldpath, newpath); err != nil {
+		return pathError("rename", oldname, err)
+	}
+	return nil
+}
+
+func (s *sftpFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := s.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Chmod(p, mode); err != nil {
+		return pathError("chmod", name, err)
+	}
+	return nil
+}
+
+// sftpDir is an open directory.Entries are read on the first ReadDir
+type sftpDir struct {
+	fs      *sftpFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *sftpDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *sftpDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *sftpDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries (all the remaining if n <= 0)
+// like os.File.ReadDir does
+func (d *sftpDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
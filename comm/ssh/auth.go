@@ -0,0 +1,216 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/dorzheh/infra/comm/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// authMethods builds the authentication methods in the configured order.
+// The returned closer releases the ssh-agent connection (if any) and
+// must be called once the handshake is over.
+// Key files failed to load are skipped, their errors are returned as
+// skipped and reported only if the authentication fails
+func authMethods(c *common.Config) (auth []ssh.AuthMethod, closer io.Closer, skipped error, err error) {
+	order := c.AuthOrder
+	if len(order) == 0 {
+		order = common.DefaultAuthOrder
+	}
+	closer = nopCloser{}
+	defer func() {
+		if err != nil {
+			closer.Close()
+			auth, closer, skipped = nil, nil, nil
+		}
+	}()
+
+	// agent and key file signers are offered by a single "publickey"
+	// method since the client tries every method name only once
+	var signers []ssh.Signer
+	pubkeyAdded := false
+	for _, method := range order {
+		switch method {
+		case common.AuthAgent:
+			if !c.UseAgent {
+				continue
+			}
+			agentKeys, agentConn, aerr := agentSigners()
+			if aerr != nil {
+				err = aerr
+				return
+			}
+			closer = agentConn
+			signers = append(signers, agentKeys...)
+		case common.AuthPublicKey:
+			var keySigners []ssh.Signer
+			keySigners, skipped = keyFileSigners(c)
+			signers = append(signers, keySigners...)
+		case common.AuthKeyboardInteractive:
+			if c.KeyboardInteractive != nil {
+				auth = append(auth, ssh.KeyboardInteractive(ssh.KeyboardInteractiveChallenge(c.KeyboardInteractive)))
+			} else if c.Password != "" || c.Credentials != nil {
+				auth = append(auth, ssh.KeyboardInteractive(passwordChallenge(c.ResolvePassword)))
+			}
+			continue
+		case common.AuthPassword:
+			if c.Password != "" || c.Credentials != nil {
+				auth = append(auth, ssh.PasswordCallback(c.ResolvePassword))
+			}
+			continue
+		default:
+			err = fmt.Errorf("unknown authentication method %d", method)
+			return
+		}
+		if !pubkeyAdded {
+			pubkeyAdded = true
+			// the callback reads the final slice, so signers collected
+			// later in the loop are offered as well
+			auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return signers, nil
+			}))
+		}
+	}
+	return
+}
+
+// agentSigners returns the signers held by the agent listening on SSH_AUTH_SOCK
+func agentSigners() ([]ssh.Signer, io.Closer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, err
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return signers, conn, nil
+}
+
+// keyFileSigners loads PrvtKeyFile (if exists) and PrvtKeyFiles.
+// The files failed to load are skipped and their errors are joined
+func keyFileSigners(c *common.Config) ([]ssh.Signer, error) {
+	var files []string
+	if _, err := os.Stat(c.PrvtKeyFile); err == nil {
+		files = append(files, c.PrvtKeyFile)
+	}
+	files = append(files, c.PrvtKeyFiles...)
+
+	var signers []ssh.Signer
+	var errs []error
+	for _, file := range files {
+		fileSigners, err := keyFileSigner(file, c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		signers = append(signers, fileSigners...)
+	}
+	return signers, errors.Join(errs...)
+}
+
+// keyFileSigner loads the key and its certificate (if exists)
+func keyFileSigner(file string, c *common.Config) ([]ssh.Signer, error) {
+	key, err := getKeyWithPassphrase(file, c)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := getCert(file + "-cert.pub")
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return []ssh.Signer{key}, nil
+	}
+	certSigner, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return []ssh.Signer{certSigner, key}, nil
+}
+
+func getKeyWithPassphrase(pathToKeyFile string, c *common.Config) (ssh.Signer, error) {
+	key, err := getKey(pathToKeyFile)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return key, err
+	}
+	var passphrase []byte
+	switch {
+	case c.Passphrase == "" && c.PassphraseFunc != nil:
+		if passphrase, err = c.PassphraseFunc(pathToKeyFile); err != nil {
+			return nil, err
+		}
+	case c.Passphrase != "" || c.Credentials != nil:
+		pass, err := c.ResolvePassphrase(pathToKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pathToKeyFile, err)
+		}
+		passphrase = []byte(pass)
+	default:
+		return nil, fmt.Errorf("%s: private key is encrypted and no passphrase provided", pathToKeyFile)
+	}
+	buf, err := ioutil.ReadFile(pathToKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err = ssh.ParsePrivateKeyWithPassphrase(buf, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pathToKeyFile, err)
+	}
+	return key, nil
+}
+
+// getCert loads OpenSSH certificate.Returns nil if the file does not exist
+func getCert(pathToCertFile string) (*ssh.Certificate, error) {
+	buf, err := ioutil.ReadFile(pathToCertFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pathToCertFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a certificate", pathToCertFile)
+	}
+	return cert, nil
+}
+
+// passwordChallenge answers every non-echoed keyboard-interactive
+// question with the password.The password is resolved on the first
+// such question
+func passwordChallenge(password func() (string, error)) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				pass, err := password()
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = pass
+			}
+		}
+		return answers, nil
+	}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
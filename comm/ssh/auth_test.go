@@ -0,0 +1,200 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// publicKeyServer accepts only the given key
+func publicKeyServer(t *testing.T, pub ssh.PublicKey) *sshtest.Server {
+	return sshtest.NewServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return nil, nil
+			}
+			return nil, sshtest.ErrAuth
+		},
+	})
+}
+
+func TestAuthEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authtest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := publicKeyServer(t, signer.PublicKey())
+
+	conf := s.Config()
+	conf.Password = ""
+	conf.PrvtKeyFiles = []string{keyFile}
+	if _, err := NewSshConn(conf); err == nil || !strings.Contains(err.Error(), "no passphrase provided") {
+		t.Fatalf("expected missing passphrase error, got %v", err)
+	}
+	conf.PassphraseFunc = func(file string) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+}
+
+func TestAuthSkipsBadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authtest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	badKey := filepath.Join(dir, "id_bad")
+	if err := ioutil.WriteFile(badKey, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the password is tried once the key files fail to load
+	conf := sshtest.NewServer(t, nil).Config()
+	conf.PrvtKeyFiles = []string{badKey, filepath.Join(dir, "missing")}
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+}
+
+func TestAuthAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authtest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer os.Unsetenv("SSH_AUTH_SOCK")
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := publicKeyServer(t, signer.PublicKey()).Config()
+	conf.Password = ""
+	conf.UseAgent = true
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+}
+
+func TestAuthKeyboardInteractive(t *testing.T) {
+	s := sshtest.NewServer(t, &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(c.User(), "", []string{"Verification code: "}, []bool{true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != "123456" {
+				return nil, sshtest.ErrAuth
+			}
+			return nil, nil
+		},
+	})
+	conf := s.Config()
+	conf.AuthOrder = []common.AuthMethod{common.AuthKeyboardInteractive}
+	conf.KeyboardInteractive = func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"123456"}, nil
+	}
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+}
+
+func TestAuthCredentials(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	conf := s.Config()
+	password := conf.Password
+	conf.Password = ""
+	calls := 0
+	conf.Credentials = common.CredentialFunc(func(req *common.CredentialRequest) (string, error) {
+		calls++
+		if req.Kind != common.CredentialPassword || req.User != conf.User {
+			t.Errorf("unexpected request %+v", req)
+		}
+		return password, nil
+	})
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+	if calls == 0 {
+		t.Fatal("credentials were not requested")
+	}
+
+}
+
+func TestRedactError(t *testing.T) {
+	conf := &common.Config{Host: "127.0.0.1", Port: "22", Proxy: "%zz://user:s3cret@proxy"}
+	_, err := NewSshConn(conf)
+	if err == nil {
+		t.Fatal("expected invalid proxy error")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Fatalf("secret leaked: %s", err)
+	}
+}
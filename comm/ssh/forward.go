@@ -0,0 +1,329 @@
+// Port forwarding
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ForwardStats accounts connections handled by a forward
+type ForwardStats struct {
+	// connections being forwarded
+	Active int64
+	// connections accepted so far
+	Total int64
+	// connections the other side of the tunnel failed to be reached for
+	Failed int64
+	// bytes sent from the accepting side to the dialed one
+	BytesSent int64
+	// bytes sent back to the accepting side
+	BytesReceived int64
+}
+
+// Forward is a running port forwarding.
+// It is stopped by Close or once the connection is closed
+type Forward struct {
+	conn     *SshConn
+	listener net.Listener
+	// connects accepted connection to the other side of the tunnel
+	dial func(net.Conn) (net.Conn, error)
+
+	active, total, failed, sent, received int64
+
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// ForwardLocal listens on the local address and forwards accepted
+// connections to remoteAddr reached from the remote host (ssh -L)
+func (c *SshConn) ForwardLocal(localAddr, remoteAddr string) (*Forward, error) {
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	return c.startForward(l, func(net.Conn) (net.Conn, error) {
+		return c.Client.Dial("tcp", remoteAddr)
+	})
+}
+
+// ForwardRemote asks the remote host to listen on remoteAddr and
+// forwards connections accepted there to the local address (ssh -R)
+func (c *SshConn) ForwardRemote(remoteAddr, localAddr string) (*Forward, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.offline(); err != nil {
+		return nil, err
+	}
+	l, err := c.Client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("remote forward %s: %w", remoteAddr, err)
+	}
+	return c.startForward(l, func(net.Conn) (net.Conn, error) {
+		return net.Dial("tcp", localAddr)
+	})
+}
+
+// ForwardDynamic runs SOCKS5 proxy on the local address tunneling
+// connections through the remote host (ssh -D).
+// Only CONNECT command without authentication is supported
+func (c *SshConn) ForwardDynamic(localAddr string) (*Forward, error) {
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	return c.startForward(l, func(client net.Conn) (net.Conn, error) {
+		return socks5Serve(client, func(addr string) (net.Conn, error) {
+			return c.Client.Dial("tcp", addr)
+		})
+	})
+}
+
+func (c *SshConn) startForward(l net.Listener, dial func(net.Conn) (net.Conn, error)) (*Forward, error) {
+	if err := c.offline(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	f := &Forward{conn: c, listener: l, dial: dial, conns: make(map[net.Conn]struct{})}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		l.Close()
+		return nil, c.err
+	}
+	if c.forwards == nil {
+		c.forwards = make(map[*Forward]struct{})
+	}
+	c.forwards[f] = struct{}{}
+	c.mu.Unlock()
+
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+// Addr returns the listening address.
+// For remote forwards it is the address on the remote host
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *Forward) Stats() ForwardStats {
+	return ForwardStats{
+		Active:        atomic.LoadInt64(&f.active),
+		Total:         atomic.LoadInt64(&f.total),
+		Failed:        atomic.LoadInt64(&f.failed),
+		BytesSent:     atomic.LoadInt64(&f.sent),
+		BytesReceived: atomic.LoadInt64(&f.received),
+	}
+}
+
+// Close stops listening and closes the forwarded connections
+func (f *Forward) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		err = f.listener.Close()
+		f.mu.Lock()
+		f.closed = true
+		for conn := range f.conns {
+			conn.Close()
+		}
+		f.mu.Unlock()
+		f.wg.Wait()
+
+		f.conn.mu.Lock()
+		delete(f.conn.forwards, f)
+		f.conn.mu.Unlock()
+	})
+	return err
+}
+
+func (f *Forward) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&f.total, 1)
+		if !f.track(conn) {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer f.untrack(conn)
+			f.handle(conn)
+		}()
+	}
+}
+
+func (f *Forward) handle(conn net.Conn) {
+	target, err := f.dial(conn)
+	if err != nil {
+		atomic.AddInt64(&f.failed, 1)
+		conn.Close()
+		return
+	}
+	if !f.track(target) {
+		conn.Close()
+		return
+	}
+	defer f.untrack(target)
+	atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+	pipe(conn, target, &f.sent, &f.received)
+}
+
+// track registers the connection to be closed by Close.
+// Returns false (closing the connection) if the forward is closed
+func (f *Forward) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		conn.Close()
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *Forward) untrack(conn net.Conn) {
+	f.mu.Lock()
+	delete(f.conns, conn)
+	f.mu.Unlock()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data both ways until both sides are done and closes them.
+// Amounts of bytes copied are added to sent (a to b) and received
+// (b to a) if not nil
+func pipe(a, b io.ReadWriteCloser, sent, received *int64) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst io.WriteCloser, src io.Reader, counter *int64) {
+		defer wg.Done()
+		if counter != nil {
+			dst = &countingWriter{dst, counter}
+		}
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			// let the other side finish its response
+			cw.CloseWrite()
+			return
+		}
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go copyHalf(b, a, sent)
+	go copyHalf(a, b, received)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+func (w *countingWriter) CloseWrite() error {
+	if cw, ok := w.WriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return w.Close()
+}
+
+// socks5Serve handles SOCKS5 CONNECT request of the client
+// and returns connection made by dial
+func socks5Serve(client net.Conn, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 5 {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0x00
+	}
+	if !noAuth {
+		client.Write([]byte{5, 0xff})
+		return nil, errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err := client.Write([]byte{5, 0x00}); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(client, req); err != nil {
+		return nil, err
+	}
+	reply := func(code byte) {
+		client.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+	if req[1] != 1 {
+		reply(7)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(client, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(client, l); err != nil {
+			return nil, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(client, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		reply(8)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(client, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	target, err := dial(addr)
+	if err != nil {
+		reply(5)
+		return nil, err
+	}
+	reply(0)
+	return target, nil
+}
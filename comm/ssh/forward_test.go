@@ -0,0 +1,198 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+// newEchoServer starts local TCP server echoing back everything it reads
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// echo sends msg over conn and checks it is echoed back
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("expected %q, got %q", msg, buf)
+	}
+}
+
+func waitStats(t *testing.T, f *Forward, check func(ForwardStats) bool) ForwardStats {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stats := f.Stats()
+		if check(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardLocal(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	target := newEchoServer(t)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	f, err := c.ForwardLocal("127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	waitStats(t, f, func(s ForwardStats) bool {
+		return s.Active == 1 && s.Total == 1 && s.BytesSent == 5 && s.BytesReceived == 5
+	})
+	conn.Close()
+	waitStats(t, f, func(s ForwardStats) bool { return s.Active == 0 })
+
+	// active connections are closed along with the forward
+	conn, err = net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "again")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("forwarded connection is still open")
+	}
+	if _, err := net.Dial("tcp", f.Addr().String()); err == nil {
+		t.Error("forward is still listening")
+	}
+}
+
+func TestForwardRemote(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	target := newEchoServer(t)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	f, err := c.ForwardRemote("127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+	waitStats(t, f, func(s ForwardStats) bool { return s.Total == 1 && s.Active == 0 })
+
+	// the forward is closed along with the connection
+	c.ConnClose()
+	if _, err := net.Dial("tcp", f.Addr().String()); err == nil {
+		t.Error("remote forward is still listening")
+	}
+}
+
+func TestForwardBrokenConn(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	target := newEchoServer(t)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	f, err := c.ForwardLocal("127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DropConnections()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("forward of broken connection is still listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.Broken() {
+		t.Fatal("connection is not broken")
+	}
+}
+
+func TestForwardDynamic(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	target := newEchoServer(t)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	f, err := c.ForwardDynamic("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dial, err := proxyDialer("socks5://" + f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	// unreachable target
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	if _, err := dial(context.Background(), "tcp", l.Addr().String()); err == nil {
+		t.Error("expected connect error")
+	}
+	waitStats(t, f, func(s ForwardStats) bool { return s.Total == 2 && s.Failed == 1 })
+}
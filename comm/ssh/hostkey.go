@@ -0,0 +1,187 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dorzheh/infra/comm/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyError is returned when the host key offered by the server
+// cannot be verified
+type HostKeyError struct {
+	Host string
+	// the key offered by the server
+	Offered ssh.PublicKey
+	// keys found in the known_hosts file for the host.
+	// Empty if the host is unknown
+	Expected []ssh.PublicKey
+	// the pinned fingerprint (HostKeyFingerprint policy only)
+	ExpectedFingerprint string
+}
+
+func (e *HostKeyError) Error() string {
+	offered := e.Offered.Type() + " " + ssh.FingerprintSHA256(e.Offered)
+	switch {
+	case e.ExpectedFingerprint != "":
+		return fmt.Sprintf("host key mismatch for %s: offered %s, expected %s",
+			e.Host, offered, e.ExpectedFingerprint)
+	case len(e.Expected) == 0:
+		return fmt.Sprintf("unknown host %s: offered %s", e.Host, offered)
+	}
+	var expected []string
+	for _, k := range e.Expected {
+		expected = append(expected, k.Type()+" "+ssh.FingerprintSHA256(k))
+	}
+	return fmt.Sprintf("host key mismatch for %s: offered %s, expected %s",
+		e.Host, offered, strings.Join(expected, ", "))
+}
+
+// Unknown reports whether the host has no entry in the known_hosts file
+func (e *HostKeyError) Unknown() bool {
+	return e.ExpectedFingerprint == "" && len(e.Expected) == 0
+}
+
+// DefaultKnownHostsFile returns path to ~/.ssh/known_hosts
+func DefaultKnownHostsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// hostKeyCallback returns the callback matching the configured policy
+// and the host key algorithms the client should ask for
+func hostKeyCallback(c *common.Config) (ssh.HostKeyCallback, []string, error) {
+	switch c.HostKeyPolicy {
+	case common.HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case common.HostKeyFingerprint:
+		if c.HostKeyFingerprint == "" {
+			return nil, nil, errors.New("host key fingerprint is not set")
+		}
+		return fingerprintCallback(c.HostKeyFingerprint), nil, nil
+	case common.HostKeyKnownHosts, common.HostKeyTOFU:
+		return knownHostsCallback(c)
+	}
+	return nil, nil, fmt.Errorf("unknown host key policy %d", c.HostKeyPolicy)
+}
+
+func fingerprintCallback(fingerprint string) ssh.HostKeyCallback {
+	// fingerprints without the SHA256 prefix are legacy MD5 ones
+	sum := ssh.FingerprintSHA256
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		sum = ssh.FingerprintLegacyMD5
+		fingerprint = strings.TrimPrefix(fingerprint, "MD5:")
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if sum(key) != fingerprint {
+			return &HostKeyError{Host: hostname, Offered: key, ExpectedFingerprint: fingerprint}
+		}
+		return nil
+	}
+}
+
+// tofuLock serializes appends to known_hosts files
+var tofuLock sync.Mutex
+
+func knownHostsCallback(c *common.Config) (ssh.HostKeyCallback, []string, error) {
+	file := c.KnownHostsFile
+	if file == "" {
+		var err error
+		if file, err = DefaultKnownHostsFile(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.HostKeyPolicy == common.HostKeyTOFU {
+		if err := touchKnownHosts(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	algos := knownHostKeyAlgorithms(check, net.JoinHostPort(c.Host, c.Port))
+
+	cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) == 0 && c.HostKeyPolicy == common.HostKeyTOFU {
+			return appendKnownHost(file, hostname, remote, key)
+		}
+		hkErr := &HostKeyError{Host: hostname, Offered: key}
+		for _, k := range keyErr.Want {
+			hkErr.Expected = append(hkErr.Expected, k.Key)
+		}
+		return hkErr
+	}
+	return cb, algos, nil
+}
+
+// knownHostKeyAlgorithms looks up the key types recorded for the address
+// so that the server is asked for a key we can actually verify
+func knownHostKeyAlgorithms(check ssh.HostKeyCallback, addr string) []string {
+	var keyErr *knownhosts.KeyError
+	// a dummy key never matches, so the error lists the known keys
+	if err := check(addr, &net.TCPAddr{IP: net.IPv4zero}, dummyKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		switch k.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, k.Key.Type())
+		}
+	}
+	return algos
+}
+
+func touchKnownHosts(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func appendKnownHost(file, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	tofuLock.Lock()
+	defer tofuLock.Unlock()
+
+	addrs := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if ip := knownhosts.Normalize(remote.String()); ip != addrs[0] {
+			addrs = append(addrs, ip)
+		}
+	}
+	fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fmt.Fprintln(fd, knownhosts.Line(addrs, key))
+	return err
+}
+
+type dummyKey struct{}
+
+func (dummyKey) Type() string                                 { return "dummy" }
+func (dummyKey) Marshal() []byte                              { return []byte("dummy") }
+func (dummyKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("dummy key") }
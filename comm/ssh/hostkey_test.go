@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dorzheh/infra/comm/common"
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyTOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkeytest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &common.Config{
+		Host:           "127.0.0.1",
+		Port:           "2222",
+		HostKeyPolicy:  common.HostKeyTOFU,
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+	key := newHostKey(t)
+
+	cb, _, err := hostKeyCallback(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("127.0.0.1:2222", addr, key); err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+
+	// the key is recorded now, so strict mode must accept it
+	conf.HostKeyPolicy = common.HostKeyKnownHosts
+	cb, algos, err := hostKeyCallback(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected host key algorithms %v", algos)
+	}
+	if err := cb("127.0.0.1:2222", addr, key); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newHostKey(t)
+	err = cb("127.0.0.1:2222", addr, other)
+	var hkErr *HostKeyError
+	if !errors.As(err, &hkErr) {
+		t.Fatalf("expected HostKeyError, got %v", err)
+	}
+	if hkErr.Unknown() || len(hkErr.Expected) != 1 ||
+		ssh.FingerprintSHA256(hkErr.Expected[0]) != ssh.FingerprintSHA256(key) ||
+		ssh.FingerprintSHA256(hkErr.Offered) != ssh.FingerprintSHA256(other) {
+		t.Fatalf("unexpected error contents: %s", hkErr)
+	}
+
+	err = cb("127.0.0.2:2222", addr, other)
+	if !errors.As(err, &hkErr) || !hkErr.Unknown() {
+		t.Fatalf("expected unknown host error, got %v", err)
+	}
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	key := newHostKey(t)
+	conf := &common.Config{
+		HostKeyPolicy:      common.HostKeyFingerprint,
+		HostKeyFingerprint: ssh.FingerprintSHA256(key),
+	}
+	cb, _, err := hostKeyCallback(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("host:22", nil, key); err != nil {
+		t.Fatal(err)
+	}
+	var hkErr *HostKeyError
+	if err := cb("host:22", nil, newHostKey(t)); !errors.As(err, &hkErr) {
+		t.Fatalf("expected HostKeyError, got %v", err)
+	}
+}
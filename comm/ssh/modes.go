@@ -0,0 +1,78 @@
+// Dry-run, recording and replay modes (Config.DryRun and Config.Transcript)
+
+package ssh
+
+import (
+	"errors"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+var (
+	// ErrDryRun is returned by operations which cannot be faked in dry-run mode
+	// (interactive sessions, files opened for writing)
+	ErrDryRun = errors.New("not available in dry-run mode")
+	// ErrOffline is returned by operations of replayed connections
+	// which need the host (reading files, port forwarding...)
+	ErrOffline = errors.New("not available while replaying the transcript")
+)
+
+// replayConn returns connection answering from the transcript
+// without connecting to the host
+func replayConn(c *common.Config) *SshConn {
+	return &SshConn{config: c, done: make(chan struct{})}
+}
+
+func (c *SshConn) host() string {
+	return c.config.String()
+}
+
+func (c *SshConn) dryRun() bool {
+	return c.config != nil && c.config.DryRun != nil
+}
+
+func (c *SshConn) replaying() bool {
+	return c.config != nil && c.config.Transcript != nil && c.config.Transcript.Replaying()
+}
+
+func (c *SshConn) recording() bool {
+	return c.config != nil && c.config.Transcript != nil && !c.config.Transcript.Replaying()
+}
+
+// offline returns ErrOffline for replayed connections
+func (c *SshConn) offline() error {
+	if c.Client == nil {
+		return ErrOffline
+	}
+	return nil
+}
+
+// intercept handles the operation in dry-run and replay modes.
+// If done is false, the operation must be done and recorded
+func (c *SshConn) intercept(op string, args ...string) (done bool, err error) {
+	switch {
+	case c.dryRun():
+		common.LogDryRun(c.config.DryRun, c.host(), op, args...)
+		return true, nil
+	case c.replaying():
+		_, err := c.config.Transcript.Replay(c.host(), op, args...)
+		return true, err
+	}
+	return false, nil
+}
+
+func (c *SshConn) record(op string, args []string, res *common.Result, err error) {
+	if c.recording() {
+		c.config.Transcript.Record(c.host(), op, args, res, err)
+	}
+}
+
+// mutate runs fn changing the remote files unless intercepted
+func (c *SshConn) mutate(op string, args []string, fn func() error) error {
+	if done, err := c.intercept(op, args...); done {
+		return err
+	}
+	err := fn()
+	c.record(op, args, nil, err)
+	return err
+}
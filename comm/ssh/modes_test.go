@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestDryRun(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	dir, err := ioutil.TempDir("", "dryrun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+
+	var log bytes.Buffer
+	conf := s.Config()
+	conf.DryRun = &log
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+	if _, err := c.Exec("touch " + file); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Upload("/etc/hostname", file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Create(file); !errors.Is(err, ErrDryRun) {
+		t.Fatalf("expected ErrDryRun, got %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("the file is created in dry-run mode")
+	}
+	// reads are done
+	if _, err := c.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	host := conf.String()
+	for _, want := range []string{host + ": run touch", host + ": write 0600", host + ": upload /etc/hostname"} {
+		if !strings.Contains(log.String(), want) {
+			t.Fatalf("%q is not logged:\n%s", want, log.String())
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	dir, err := ioutil.TempDir("", "record-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+
+	conf := s.Config()
+	conf.Transcript = common.NewTranscript()
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Exec("echo out; echo err >&2; exit 2"); err == nil {
+		t.Fatal("expected exit error")
+	}
+	if err := c.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.ReadFile(file); err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	c.ConnClose()
+	path := filepath.Join(dir, "transcript.json")
+	if err := conf.Transcript.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// no server is needed anymore
+	replayConf := &common.Config{Host: conf.Host, Port: conf.Port, User: conf.User}
+	if replayConf.Transcript, err = common.LoadTranscript(path); err != nil {
+		t.Fatal(err)
+	}
+	s.DropConnections()
+	c, err = NewSshConn(replayConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+	res, err := c.Exec("echo out; echo err >&2; exit 2")
+	var exitErr *common.ExitError
+	if !errors.As(err, &exitErr) || res.ExitStatus != 2 || res.Stdout != "out\n" || res.Stderr != "err\n" {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	if err := c.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.ReadFile(file); err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if _, err := c.Exec("uname"); !errors.Is(err, common.ErrNotRecorded) {
+		t.Fatalf("expected ErrNotRecorded, got %v", err)
+	}
+	if _, err := c.Stat(file); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+// DefaultMaxSessions matches the default MaxSessions of OpenSSH server
+const DefaultMaxSessions = 10
+
+var ErrPoolClosed = errors.New("ssh connection pool is closed")
+
+// Pool caches connections keyed by host, user, credentials and the
+// other connection settings.
+// Sessions of all the users of a host are multiplexed over a single
+// connection which is re-established transparently once it is broken
+type Pool struct {
+	// connections unused for IdleTimeout are closed (never if zero)
+	IdleTimeout time.Duration
+	// max concurrent sessions per connection (defaults to DefaultMaxSessions).
+	// Sessions refused by the server because of its own lower limit
+	// are retried once another session is closed
+	MaxSessions int
+
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	closed  bool
+	done    chan struct{}
+}
+
+type poolEntry struct {
+	// serializes dialing
+	mu       sync.Mutex
+	conn     *SshConn
+	lastUsed time.Time
+}
+
+func NewPool(idleTimeout time.Duration, maxSessions int) *Pool {
+	p := &Pool{
+		IdleTimeout: idleTimeout,
+		MaxSessions: maxSessions,
+		entries:     make(map[string]*poolEntry),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.reap()
+	}
+	return p
+}
+
+// Get returns connection to the host described by config, dialing it if
+// there is no usable connection yet.
+// The connection is owned by the pool and must not be closed
+func (p *Pool) Get(config *common.Config) (*SshConn, error) {
+	return p.GetContext(context.Background(), config)
+}
+
+func (p *Pool) GetContext(ctx context.Context, config *common.Config) (*SshConn, error) {
+	key := poolKey(config)
+	for {
+		e, err := p.entry(key)
+		if err != nil {
+			return nil, err
+		}
+		e.mu.Lock()
+		if !p.holds(key, e) {
+			// reaped before locked, a connection dialed into it
+			// would never be closed
+			e.mu.Unlock()
+			continue
+		}
+		conn, err := p.connect(ctx, e, config)
+		e.mu.Unlock()
+		return conn, err
+	}
+}
+
+// entry returns the entry of the key, adding it if missing
+func (p *Pool) entry(key string) (*poolEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	e, ok := p.entries[key]
+	if !ok {
+		e = new(poolEntry)
+		p.entries[key] = e
+	}
+	return e, nil
+}
+
+// holds reports whether the entry is still pooled under the key
+func (p *Pool) holds(key string, e *poolEntry) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.entries[key] == e
+}
+
+// connect returns the connection of the locked entry, dialing it if
+// there is no usable connection yet
+func (p *Pool) connect(ctx context.Context, e *poolEntry, config *common.Config) (*SshConn, error) {
+	e.lastUsed = time.Now()
+	if e.conn != nil && e.conn.Err() == nil {
+		return e.conn, nil
+	}
+	if e.conn != nil {
+		e.conn.ConnClose()
+		e.conn = nil
+	}
+	conn, err := NewSshConnContext(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	maxSessions := p.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxSessions
+	}
+	conn.limiter = newSessionLimiter(maxSessions)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.ConnClose()
+		return nil, ErrPoolClosed
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+// Exec runs the command on the host described by config.
+// If the pooled connection turns out to be broken before the command
+// is started, the connection is re-established and the command is retried
+func (p *Pool) Exec(ctx context.Context, config *common.Config, cmd string) (*common.Result, error) {
+	return p.do(ctx, config, func(conn *SshConn) (*common.Result, error) {
+		return conn.ExecContext(ctx, cmd)
+	})
+}
+
+// Stream is like Exec but behaves as SshConn.StreamContext
+func (p *Pool) Stream(ctx context.Context, config *common.Config, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*common.Result, error) {
+	return p.do(ctx, config, func(conn *SshConn) (*common.Result, error) {
+		return conn.StreamContext(ctx, cmd, stdin, stdout, stderr)
+	})
+}
+
+func (p *Pool) do(ctx context.Context, config *common.Config, fn func(*SshConn) (*common.Result, error)) (*common.Result, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := p.GetContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		res, err := fn(conn)
+		if res == nil && errors.Is(err, ErrConnBroken) && attempt == 0 {
+			continue
+		}
+		return res, err
+	}
+}
+
+// Close closes all the pooled connections
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	entries := p.entries
+	p.entries = nil
+	p.mu.Unlock()
+
+	for _, e := range entries {
+		e.mu.Lock()
+		if e.conn != nil {
+			e.conn.ConnClose()
+		}
+		e.mu.Unlock()
+	}
+}
+
+// reap closes idle connections
+func (p *Pool) reap() {
+	ticker := time.NewTicker(p.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		for key, e := range p.entries {
+			if !e.mu.TryLock() {
+				// being dialed
+				continue
+			}
+			if time.Since(e.lastUsed) > p.IdleTimeout && (e.conn == nil || e.conn.limiter.busy() == 0) {
+				if e.conn != nil {
+					e.conn.ConnClose()
+				}
+				delete(p.entries, key)
+			}
+			e.mu.Unlock()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// poolKey identifies connections which may be shared: every setting
+// affecting the dial, authentication, host key verification and use of
+// the connection is part of the key.
+// Secrets are hashed to keep them out of the key.
+// Credentials are resolved lazily, so configs differing only by
+// the provider share connections.
+// Dry-run, recording and replaying configs get connections of their own
+func poolKey(c *common.Config) string {
+	h := sha256.New()
+	writePoolKey(h, c)
+	return fmt.Sprintf("%s@%s:%s|%x", c.User, c.Host, c.Port, h.Sum(nil))
+}
+
+func writePoolKey(w io.Writer, c *common.Config) {
+	fmt.Fprintf(w, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00", c.User, c.Host, c.Port,
+		c.Password, c.Passphrase, c.PrvtKeyFile, strings.Join(c.PrvtKeyFiles, "\x00"))
+	fmt.Fprintf(w, "%p\x00%t\x00%p\x00%v\x00", c.PassphraseFunc, c.UseAgent, c.KeyboardInteractive, c.AuthOrder)
+	fmt.Fprintf(w, "%d\x00%s\x00%s\x00", c.HostKeyPolicy, c.KnownHostsFile, c.HostKeyFingerprint)
+	fmt.Fprintf(w, "%s\x00%d\x00%d\x00%s\x00", c.KeepAliveInterval, c.KeepAliveCountMax, c.Transfer, c.Proxy)
+	fmt.Fprintf(w, "%p\x00%p\x00%p\x00%d\x00", c.DryRun, c.Transcript, c.Retry, len(c.JumpHosts))
+	for _, hop := range c.JumpHosts {
+		writePoolKey(w, hop)
+	}
+}
+
+// sessionLimiter limits amount of concurrent sessions
+type sessionLimiter struct {
+	slots chan struct{}
+
+	mu       sync.Mutex
+	released chan struct{}
+}
+
+func newSessionLimiter(max int) *sessionLimiter {
+	return &sessionLimiter{
+		slots:    make(chan struct{}, max),
+		released: make(chan struct{}),
+	}
+}
+
+func (l *sessionLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancel gives back the slot of a session failed to open.
+// Returns amount of sessions still active
+func (l *sessionLimiter) cancel() int {
+	<-l.slots
+	return len(l.slots)
+}
+
+// release gives back the slot of a closed session and wakes up
+// those waiting for it
+func (l *sessionLimiter) release() {
+	<-l.slots
+	l.mu.Lock()
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// releasedChan returns channel closed on the next release
+func (l *sessionLimiter) releasedChan() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.released
+}
+
+func (l *sessionLimiter) busy() int {
+	return len(l.slots)
+}
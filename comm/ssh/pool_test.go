@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestPoolReuseAndReconnect(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	p := NewPool(time.Minute, 2)
+	defer p.Close()
+
+	conf := s.Config()
+	c1, err := p.Get(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.Get(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Fatal("connection is not reused")
+	}
+
+	// more concurrent commands than MaxSessions
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Exec(context.Background(), conf, "sleep 0.1"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	s.DropConnections()
+	for i := 0; !c1.Broken(); i++ {
+		if i == 100 {
+			t.Fatal("broken connection not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err := p.Exec(context.Background(), conf, "echo ok")
+	if err != nil || res.Stdout != "ok\n" {
+		t.Fatalf("command after reconnect failed: %v", err)
+	}
+	if c3, _ := p.Get(conf); c3 == c1 {
+		t.Fatal("broken connection is reused")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	p := NewPool(50*time.Millisecond, 0)
+	defer p.Close()
+
+	c, err := p.Get(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; c.Err() == nil; i++ {
+		if i == 100 {
+			t.Fatal("idle connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	base := func() *common.Config {
+		return &common.Config{Host: "10.0.0.1", Port: "22", User: "root", Password: "secret"}
+	}
+	if poolKey(base()) != poolKey(base()) {
+		t.Fatal("equal configs have different keys")
+	}
+	if strings.Contains(poolKey(base()), "secret") {
+		t.Fatal("password is not hashed")
+	}
+	for name, change := range map[string]func(c *common.Config){
+		"password":    func(c *common.Config) { c.Password = "other" },
+		"key files":   func(c *common.Config) { c.PrvtKeyFiles = []string{"/root/.ssh/id"} },
+		"agent":       func(c *common.Config) { c.UseAgent = true },
+		"auth order":  func(c *common.Config) { c.AuthOrder = []common.AuthMethod{common.AuthPassword} },
+		"host key":    func(c *common.Config) { c.HostKeyPolicy = common.HostKeyInsecure },
+		"known hosts": func(c *common.Config) { c.KnownHostsFile = "/tmp/known_hosts" },
+		"fingerprint": func(c *common.Config) { c.HostKeyFingerprint = "SHA256:x" },
+		"transfer":    func(c *common.Config) { c.Transfer = common.TransferSCP },
+		"proxy":       func(c *common.Config) { c.Proxy = "socks5://proxy:1080" },
+		"jump host":   func(c *common.Config) { c.JumpHosts = []*common.Config{base()} },
+		"retry":       func(c *common.Config) { c.Retry = common.NoRetry },
+		"jump host key": func(c *common.Config) {
+			c.JumpHosts = []*common.Config{{Host: "bastion", HostKeyPolicy: common.HostKeyInsecure}}
+		},
+	} {
+		c := base()
+		change(c)
+		if poolKey(c) == poolKey(base()) {
+			t.Errorf("%s is not part of the key", name)
+		}
+	}
+}
+
+func TestPoolHostKeyPolicy(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	p := NewPool(time.Minute, 0)
+	defer p.Close()
+
+	insecure := s.Config()
+	insecure.HostKeyPolicy = common.HostKeyInsecure
+	if _, err := p.Get(insecure); err != nil {
+		t.Fatal(err)
+	}
+	pinned := s.Config()
+	pinned.HostKeyFingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	if _, err := p.Get(pinned); err == nil {
+		t.Fatal("connection verified by another policy is reused")
+	}
+}
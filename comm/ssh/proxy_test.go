@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestJumpHosts(t *testing.T) {
+	first := sshtest.NewServer(t, nil)
+	second := sshtest.NewServer(t, nil)
+	target := sshtest.NewServer(t, nil)
+
+	config := target.Config()
+	config.JumpHosts = []*common.Config{first.Config(), second.Config()}
+	c, err := NewSshConn(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, err := c.Run("echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "hello\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	c.ConnClose()
+
+	// the hop is verified by its own settings
+	config.JumpHosts[1].HostKeyFingerprint = first.Config().HostKeyFingerprint
+	if _, err := NewSshConn(config); err == nil || !strings.Contains(err.Error(), "jump host") {
+		t.Errorf("expected jump host error, got %v", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	target := sshtest.NewServer(t, nil)
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			proxy := newTestProxy(t, scheme, "user", "secret")
+			config := target.Config()
+
+			config.Proxy = scheme + "://user:secret@" + proxy.Addr().String()
+			c, err := NewSshConn(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, _, err := c.Run("echo hello")
+			c.ConnClose()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stdout != "hello\n" {
+				t.Errorf("unexpected output %q", stdout)
+			}
+
+			config.Proxy = scheme + "://user:wrong@" + proxy.Addr().String()
+			if _, err := NewSshConn(config); err == nil || !strings.Contains(err.Error(), "proxy") {
+				t.Errorf("expected proxy error, got %v", err)
+			}
+		})
+	}
+}
+
+// newTestProxy starts SOCKS5 or HTTP CONNECT proxy requiring
+// the given credentials
+func newTestProxy(t *testing.T, scheme, user, pass string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	handle := socks5ProxyServe
+	if scheme == "http" {
+		handle = httpProxyServe
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				target, err := handle(conn, user, pass)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				pipe(conn, target, nil, nil)
+			}()
+		}
+	}()
+	return l
+}
+
+func socks5ProxyServe(conn net.Conn, user, pass string) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, make([]byte, buf[1])); err != nil {
+		return nil, err
+	}
+	conn.Write([]byte{5, 2})
+	// RFC 1929
+	readString := func() string {
+		l, _ := r.ReadByte()
+		s := make([]byte, l)
+		io.ReadFull(r, s)
+		return string(s)
+	}
+	r.ReadByte()
+	if readString() != user || readString() != pass {
+		conn.Write([]byte{1, 1})
+		return nil, sshtest.ErrAuth
+	}
+	conn.Write([]byte{1, 0})
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readString()
+	}
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return target, nil
+}
+
+func httpProxyServe(conn net.Conn, user, pass string) (net.Conn, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if u, p, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); !ok || u != user || p != pass {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return nil, sshtest.ErrAuth
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return nil, err
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return target, nil
+}
+
+func parseProxyAuth(header string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
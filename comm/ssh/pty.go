@@ -0,0 +1,162 @@
+// Interactive sessions with pseudo-terminal
+
+package ssh
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/expect"
+	"github.com/dorzheh/infra/comm/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+type PtyOptions struct {
+	// terminal type (defaults to "xterm")
+	Term string
+	// terminal size (defaults to 80x24)
+	Width, Height int
+	// terminal modes (defaults to echo enabled at 14400 baud)
+	Modes ssh.TerminalModes
+}
+
+var defaultPtyOptions = PtyOptions{
+	Term:   "xterm",
+	Width:  80,
+	Height: 24,
+	Modes: ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	},
+}
+
+// PtySession is a remote command or login shell running with
+// pseudo-terminal.Its output (stdout and stderr are merged by the
+// terminal) is read by Read and its input is written by Write
+type PtySession struct {
+	conn    *SshConn
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	cmd     string
+	start   time.Time
+
+	expectOnce sync.Once
+	expecter   *expect.Expecter
+	closeOnce  sync.Once
+	// closed once the session is closed
+	done chan struct{}
+}
+
+// StartPty starts cmd (login shell if empty) with pseudo-terminal.
+// The remote command is sent SIGTERM and the session is closed
+// once ctx is done.
+// Fails with ErrDryRun in dry-run mode
+func (c *SshConn) StartPty(ctx context.Context, cmd string, opts *PtyOptions) (*PtySession, error) {
+	if c.dryRun() {
+		common.LogDryRun(c.config.DryRun, c.host(), "pty", cmd)
+		return nil, ErrDryRun
+	}
+	o := defaultPtyOptions
+	if opts != nil {
+		if opts.Term != "" {
+			o.Term = opts.Term
+		}
+		if opts.Width > 0 && opts.Height > 0 {
+			o.Width, o.Height = opts.Width, opts.Height
+		}
+		if opts.Modes != nil {
+			o.Modes = opts.Modes
+		}
+	}
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &PtySession{conn: c, session: session, cmd: cmd, done: make(chan struct{})}
+	if err := s.startPty(cmd, &o); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGTERM)
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+func (s *PtySession) startPty(cmd string, o *PtyOptions) (err error) {
+	if s.stdin, err = s.session.StdinPipe(); err != nil {
+		return
+	}
+	if s.stdout, err = s.session.StdoutPipe(); err != nil {
+		return
+	}
+	if err = s.session.RequestPty(o.Term, o.Height, o.Width, o.Modes); err != nil {
+		return
+	}
+	s.start = time.Now()
+	if cmd == "" {
+		return s.session.Shell()
+	}
+	return s.session.Start(cmd)
+}
+
+func (s *PtySession) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+func (s *PtySession) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+// Resize propagates the new window size to the remote terminal
+func (s *PtySession) Resize(width, height int) error {
+	return s.session.WindowChange(height, width)
+}
+
+// Expecter returns the expect-style scripting layer of the session.
+// Once it is called, the output must be read through the Expecter only
+func (s *PtySession) Expecter() *expect.Expecter {
+	s.expectOnce.Do(func() {
+		s.expecter = expect.New(s.stdout, s.stdin)
+	})
+	return s.expecter
+}
+
+// Interact connects the session to the local terminal until the remote
+// command exits.The terminal is put into raw mode and its window size
+// changes are propagated to the session
+func (s *PtySession) Interact(stdin *os.File, stdout io.Writer) error {
+	if err := pty.Interact(s.Expecter(), stdin, stdout, s.Resize); err != nil {
+		return err
+	}
+	_, err := s.Wait()
+	return err
+}
+
+// Wait waits for the remote command to exit.
+// A command exited with non-zero status yields *common.ExitError
+func (s *PtySession) Wait() (*common.Result, error) {
+	err := s.session.Wait()
+	res := &common.Result{Command: s.cmd, Duration: time.Since(s.start)}
+	return res, exitError(res, err)
+}
+
+// Close closes the session
+func (s *PtySession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.closeSession(s.session)
+	})
+	return nil
+}
@@ -0,0 +1,75 @@
+package ssh
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestPty(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	s, err := c.StartPty(context.Background(), "tty; stty size; read x; stty size; exit 3", &PtyOptions{Width: 100, Height: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e := s.Expecter()
+	if _, _, err := e.Expect(10*time.Second, regexp.MustCompile(`/dev/pts/\d+`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ExpectString(10*time.Second, "40 100"); err != nil {
+		t.Fatalf("%v, output %q", err, e.Buffered())
+	}
+	if err := s.Resize(120, 50); err != nil {
+		t.Fatal(err)
+	}
+	// let the window change reach the server before the command goes on
+	time.Sleep(100 * time.Millisecond)
+	e.SendLine("")
+	if err := e.ExpectString(10*time.Second, "50 120"); err != nil {
+		t.Fatalf("%v, output %q", err, e.Buffered())
+	}
+	res, err := s.Wait()
+	if exitErr, ok := err.(*common.ExitError); !ok || exitErr.ExitStatus != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if res.Command == "" {
+		t.Error("missing command in result")
+	}
+}
+
+func TestPtyShell(t *testing.T) {
+	server := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	s, err := c.StartPty(context.Background(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e := s.Expecter()
+	// the markers tell the output from the echoed command and prompts
+	e.SendLine("echo X$((6 * 7))X")
+	idx, match, err := e.Expect(10*time.Second, regexp.MustCompile(`X(\d+)X`))
+	if err != nil || idx != 0 || match[1] != "42" {
+		t.Fatalf("unexpected match %q %v, output %q", match, err, e.Buffered())
+	}
+	e.SendLine("exit")
+	if _, err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
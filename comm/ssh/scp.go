@@ -0,0 +1,382 @@
+// SCP protocol implementation
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/infra/utils/shellutils"
+	"golang.org/x/crypto/ssh"
+)
+
+// ScpUpload uploads src to dst over SCP
+func (c *SshConn) ScpUpload(ctx context.Context, src, dst string, opts *TransferOptions) (err error) {
+	if done, err := c.intercept("upload", src, dst); done {
+		return err
+	}
+	defer func() { c.record("upload", []string{src, dst}, nil, err) }()
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	flags := "-qt"
+	if info.IsDir() {
+		flags += "r"
+	}
+	if opts.PreserveTimes {
+		flags += "p"
+	}
+	cmd := "scp " + flags + " " + shellutils.Quote(path.Dir(dst))
+	return c.scp(ctx, cmd, func(s *scpStream) error {
+		if err := s.readAck(); err != nil {
+			return err
+		}
+		return s.send(src, path.Base(dst), info)
+	}, opts)
+}
+
+// ScpDownload downloads src to dst over SCP
+func (c *SshConn) ScpDownload(ctx context.Context, src, dst string, opts *TransferOptions) (err error) {
+	if done, err := c.intercept("download", src, dst); done {
+		return err
+	}
+	defer func() { c.record("download", []string{src, dst}, nil, err) }()
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	flags := "-qrf"
+	if opts.PreserveTimes {
+		flags += "p"
+	}
+	cmd := "scp " + flags + " " + shellutils.Quote(src)
+	return c.scp(ctx, cmd, func(s *scpStream) error {
+		return s.receive(dst)
+	}, opts)
+}
+
+// scp runs the remote scp command and speaks the protocol with it by fn
+func (c *SshConn) scp(ctx context.Context, cmd string, fn func(*scpStream) error, opts *TransferOptions) error {
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(session)
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGTERM)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	s := &scpStream{r: bufio.NewReader(r), w: w, opts: opts}
+	err = fn(s)
+	w.Close()
+	if werr := session.Wait(); err == nil {
+		err = werr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%s [%s]", strings.TrimSpace(stderr.String()), err)
+	}
+	return err
+}
+
+// ScpError is reported by the remote side of the SCP protocol
+type ScpError struct {
+	Message string
+	// fatal errors abort the transfer
+	Fatal bool
+}
+
+func (e *ScpError) Error() string {
+	return "scp: " + e.Message
+}
+
+type scpStream struct {
+	r    *bufio.Reader
+	w    io.Writer
+	opts *TransferOptions
+	// the transfer continues after warnings but they are
+	// reported once it is done
+	warnings []string
+}
+
+func (s *scpStream) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// readAck reads the response of the remote side
+func (s *scpStream) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := s.r.ReadString('\n')
+		return &ScpError{Message: strings.TrimSpace(msg), Fatal: b == 2}
+	}
+	return fmt.Errorf("scp: unexpected response %q", b)
+}
+
+// record sends a protocol record and waits for acknowledgment
+func (s *scpStream) record(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// send transfers local file or directory under the given name
+func (s *scpStream) send(local, name string, info os.FileInfo) error {
+	if s.opts.PreserveTimes {
+		mtime := info.ModTime().Unix()
+		if err := s.record("T%d 0 %d 0\n", mtime, mtime); err != nil {
+			return err
+		}
+	}
+	if info.IsDir() {
+		return s.sendDir(local, name, info)
+	}
+	return s.sendFile(local, name, info)
+}
+
+func (s *scpStream) sendDir(local, name string, info os.FileInfo) error {
+	if err := s.record("D%04o 0 %s\n", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !entry.Mode().IsRegular() {
+			// follow symlinks like scp does
+			if entry, err = os.Stat(filepath.Join(local, entry.Name())); err != nil {
+				return err
+			}
+		}
+		if err := s.send(filepath.Join(local, entry.Name()), entry.Name(), entry); err != nil {
+			return err
+		}
+	}
+	return s.record("E\n")
+}
+
+func (s *scpStream) sendFile(local, name string, info os.FileInfo) error {
+	fd, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := s.record("C%04o %d %s\n", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+	if _, err := io.Copy(s.progress(s.w, local, info.Size()), fd); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// receive reads records sent by the remote side and creates
+// appropriate files under dst
+func (s *scpStream) receive(dst string) error {
+	if err := s.ack(); err != nil {
+		return err
+	}
+	// directories being received.Empty until the first record
+	// is received if dst is not an existing directory
+	type dirEntry struct {
+		path  string
+		mode  os.FileMode
+		times *[2]time.Time
+	}
+	var dirs []dirEntry
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dirs = append(dirs, dirEntry{path: dst})
+	}
+	base := len(dirs)
+	// target path of the next record
+	target := func(name string) string {
+		if len(dirs) == 0 {
+			return dst
+		}
+		return filepath.Join(dirs[len(dirs)-1].path, name)
+	}
+	var times *[2]time.Time
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("scp: empty record")
+		}
+		switch line[0] {
+		case 1, 2:
+			if line[0] == 2 {
+				return &ScpError{Message: line[1:], Fatal: true}
+			}
+			s.warnings = append(s.warnings, line[1:])
+			continue
+		case 'T':
+			var mtime, atime int64
+			var mu, au int
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &mu, &atime, &au); err != nil {
+				return fmt.Errorf("scp: bad record %q", line)
+			}
+			times = &[2]time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+		case 'D':
+			mode, _, name, err := parseRecord(line)
+			if err != nil {
+				return err
+			}
+			// keep the directory writable until it is filled
+			dir := target(name)
+			if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := os.Chmod(dir, mode|0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{path: dir, mode: mode, times: times})
+			times = nil
+		case 'E':
+			if len(dirs) == base {
+				return errors.New("scp: unexpected end of directory")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err := os.Chmod(dir.path, dir.mode); err != nil {
+				return err
+			}
+			if dir.times != nil {
+				if err := os.Chtimes(dir.path, dir.times[0], dir.times[1]); err != nil {
+					return err
+				}
+			}
+		case 'C':
+			mode, size, name, err := parseRecord(line)
+			if err != nil {
+				return err
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+			if err := s.receiveFile(target(name), mode, size, times); err != nil {
+				return err
+			}
+			times = nil
+		default:
+			return fmt.Errorf("scp: bad record %q", line)
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+	if len(s.warnings) > 0 {
+		return &ScpError{Message: strings.Join(s.warnings, "; ")}
+	}
+	return nil
+}
+
+func (s *scpStream) receiveFile(local string, mode os.FileMode, size int64, times *[2]time.Time) error {
+	fd, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err := io.CopyN(s.progress(fd, local, size), s.r, size); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	if err := fd.Chmod(mode); err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if times != nil {
+		return os.Chtimes(local, times[0], times[1])
+	}
+	return nil
+}
+
+// parseRecord parses "C" and "D" records
+func parseRecord(line string) (mode os.FileMode, size int64, name string, err error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		err = fmt.Errorf("scp: bad record %q", line)
+		return
+	}
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		err = fmt.Errorf("scp: bad mode in record %q", line)
+		return
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || size < 0 {
+		err = fmt.Errorf("scp: bad size in record %q", line)
+		return
+	}
+	name = fields[2]
+	// never let the remote side write outside of the target
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		err = fmt.Errorf("scp: invalid file name %q", name)
+		return
+	}
+	mode = os.FileMode(m) & os.ModePerm
+	return
+}
+
+func (s *scpStream) progress(w io.Writer, file string, total int64) io.Writer {
+	return progressOf(w, file, total, s.opts)
+}
@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestScpRecursive(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	dir, err := ioutil.TempDir("", "scptest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "sub dir", "script.sh")
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\necho ok\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test server shares the filesystem with the client
+	remote := filepath.Join(dir, "remote")
+	var progress int64
+	err = c.ScpUpload(context.Background(), src, remote, &TransferOptions{
+		PreserveTimes: true,
+		Progress: func(file string, transferred, total int64) {
+			progress = transferred
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != 18 {
+		t.Fatalf("unexpected progress %d", progress)
+	}
+
+	local := filepath.Join(dir, "local")
+	if err := c.ScpDownload(context.Background(), remote, local, &TransferOptions{PreserveTimes: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(local, "sub dir", "script.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("mode %s and time %s are not preserved", info.Mode(), info.ModTime())
+	}
+
+	err = c.ScpDownload(context.Background(), filepath.Join(dir, "missing"), local, nil)
+	if _, ok := err.(*ScpError); !ok {
+		t.Fatalf("expected ScpError, got %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+// SFTP based file API
+
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/pkg/sftp"
+)
+
+// SftpClient returns SFTP client sharing the connection.
+// The client is created once and closed by ConnClose
+func (c *SshConn) SftpClient() (*sftp.Client, error) {
+	c.mu.Lock()
+	client, err := c.sftp, c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client, nil
+	}
+	if err := c.offline(); err != nil {
+		return nil, err
+	}
+	// created unlocked, so closing the connection interrupts
+	// the initialization stuck on a dead peer
+	client, err = sftp.NewClient(c.Client)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.err != nil:
+		client.Close()
+		return nil, c.err
+	case c.sftp != nil:
+		// created concurrently
+		client.Close()
+	default:
+		c.sftp = client
+	}
+	return c.sftp, nil
+}
+
+func (c *SshConn) Stat(p string) (os.FileInfo, error) {
+	client, err := c.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(p)
+}
+
+// Open opens the remote file for reading
+func (c *SshConn) Open(p string) (*sftp.File, error) {
+	client, err := c.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(p)
+}
+
+// OpenFile opens the remote file with the flags of os.OpenFile.
+// Opening for writing fails with ErrDryRun in dry-run mode
+func (c *SshConn) OpenFile(p string, flag int) (*sftp.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 && c.dryRun() {
+		return nil, ErrDryRun
+	}
+	client, err := c.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.OpenFile(p, flag)
+}
+
+// Create creates or truncates the remote file for writing.
+// Fails with ErrDryRun in dry-run mode
+func (c *SshConn) Create(p string) (*sftp.File, error) {
+	if c.dryRun() {
+		return nil, ErrDryRun
+	}
+	client, err := c.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Create(p)
+}
+
+// ReadFile returns contents of the remote file.
+// The contents are recorded to the transcript and answered by the replayed one
+func (c *SshConn) ReadFile(p string) ([]byte, error) {
+	if c.replaying() {
+		res, err := c.config.Transcript.Replay(c.host(), "read", p)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(res.Stdout), nil
+	}
+	data, err := c.readFile(p)
+	c.record("read", []string{p}, &common.Result{Stdout: string(data)}, err)
+	return data, err
+}
+
+func (c *SshConn) readFile(p string) ([]byte, error) {
+	f, err := c.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes data to the remote file creating it if necessary.
+// perm is applied to the file
+func (c *SshConn) WriteFile(p string, data []byte, perm os.FileMode) error {
+	return c.mutate("write", []string{fmt.Sprintf("%04o", perm.Perm()), p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		f, err := client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return client.Chmod(p, perm)
+	})
+}
+
+// MkdirAll creates the remote directory along with any necessary parents
+func (c *SshConn) MkdirAll(p string) error {
+	return c.mutate("mkdir", []string{p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		return client.MkdirAll(p)
+	})
+}
+
+// Remove removes the remote file or empty directory
+func (c *SshConn) Remove(p string) error {
+	return c.mutate("remove", []string{p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		return client.Remove(p)
+	})
+}
+
+// RemoveAll removes the remote path and any children it contains
+func (c *SshConn) RemoveAll(p string) error {
+	return c.mutate("remove-all", []string{p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		return client.RemoveAll(p)
+	})
+}
+
+// Rename renames the remote file replacing newpath if exists
+func (c *SshConn) Rename(oldpath, newpath string) error {
+	return c.mutate("rename", []string{oldpath, newpath}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		if err := client.PosixRename(oldpath, newpath); err == nil {
+			return nil
+		}
+		// the server does not support posix-rename@openssh.com
+		return client.Rename(oldpath, newpath)
+	})
+}
+
+func (c *SshConn) Chmod(p string, mode os.FileMode) error {
+	return c.mutate("chmod", []string{fmt.Sprintf("%04o", mode.Perm()), p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		return client.Chmod(p, mode)
+	})
+}
+
+func (c *SshConn) Chown(p string, uid, gid int) error {
+	return c.mutate("chown", []string{fmt.Sprintf("%d:%d", uid, gid), p}, func() error {
+		client, err := c.SftpClient()
+		if err != nil {
+			return err
+		}
+		return client.Chown(p, uid, gid)
+	})
+}
+
+// ReadDir returns the remote directory entries
+func (c *SshConn) ReadDir(p string) ([]os.FileInfo, error) {
+	client, err := c.SftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadDir(p)
+}
+
+// Walk walks the remote file tree rooted at root calling fn for each
+// file or directory like filepath.Walk does.
+// Returning filepath.SkipDir from fn skips the directory
+func (c *SshConn) Walk(root string, fn filepath.WalkFunc) error {
+	client, err := c.SftpClient()
+	if err != nil {
+		return err
+	}
+	walker := client.Walk(root)
+	for walker.Step() {
+		err := fn(walker.Path(), walker.Stat(), walker.Err())
+		if err == filepath.SkipDir {
+			if walker.Stat() != nil && walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SftpUpload uploads local file or directory src (recursively) to
+// the remote path dst over SFTP
+func (c *SshConn) SftpUpload(ctx context.Context, src, dst string, opts *TransferOptions) (err error) {
+	if done, err := c.intercept("upload", src, dst); done {
+		return err
+	}
+	defer func() { c.record("upload", []string{src, dst}, nil, err) }()
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	client, err := c.SftpClient()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(dst, filepath.ToSlash(rel))
+		if info.Mode()&os.ModeSymlink != 0 {
+			// follow symlinks like scp does
+			if info, err = os.Stat(local); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return c.SftpUpload(ctx, local, remote, opts)
+			}
+		}
+		if info.IsDir() {
+			if err := client.MkdirAll(remote); err != nil {
+				return err
+			}
+		} else if err := sftpPut(ctx, client, local, remote, info, opts); err != nil {
+			return err
+		}
+		if err := client.Chmod(remote, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if opts.PreserveTimes {
+			return client.Chtimes(remote, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+func sftpPut(ctx context.Context, client *sftp.Client, local, remote string, info os.FileInfo, opts *TransferOptions) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := client.Create(remote)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := progressOf(dst, local, info.Size(), opts)
+	if _, err := io.Copy(w, &ctxReader{ctx, src}); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// SftpDownload downloads remote file or directory src (recursively) to
+// the local path dst over SFTP.If dst is an existing directory,
+// src is placed inside it
+func (c *SshConn) SftpDownload(ctx context.Context, src, dst string, opts *TransferOptions) (err error) {
+	if done, err := c.intercept("download", src, dst); done {
+		return err
+	}
+	defer func() { c.record("download", []string{src, dst}, nil, err) }()
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	client, err := c.SftpClient()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+	// directories are made read-only (if needed) once they are filled
+	type dirEntry struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirEntry
+	err = c.Walk(src, func(remote string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, remote)
+		if err != nil {
+			return err
+		}
+		local := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if err := os.MkdirAll(local, info.Mode().Perm()|0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{local, info})
+			return nil
+		}
+		if err := sftpGet(ctx, client, remote, local, info, opts); err != nil {
+			return err
+		}
+		return applyAttrs(local, info, opts)
+	})
+	if err != nil {
+		return err
+	}
+	// children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := applyAttrs(dirs[i].path, dirs[i].info, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sftpGet(ctx context.Context, client *sftp.Client, remote, local string, info os.FileInfo, opts *TransferOptions) error {
+	src, err := client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	// keep src as io.WriterTo, it reads concurrently
+	w := progressOf(&ctxWriter{ctx, dst}, local, info.Size(), opts)
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+func applyAttrs(local string, info os.FileInfo, opts *TransferOptions) error {
+	if err := os.Chmod(local, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if opts.PreserveTimes {
+		return os.Chtimes(local, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// ctxReader fails reading once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxWriter fails writing once ctx is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
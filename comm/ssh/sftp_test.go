@@ -0,0 +1,174 @@
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestSftpFileAPI(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	dir, err := ioutil.TempDir("", "sftptest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := c.MkdirAll(filepath.Join(dir, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Create(filepath.Join(dir, "a", "b", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := c.Chmod(filepath.Join(dir, "a", "b", "file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rename(filepath.Join(dir, "a", "b", "file"), filepath.Join(dir, "a", "file")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.Stat(filepath.Join(dir, "a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 4 || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected file info %d %s", info.Size(), info.Mode())
+	}
+
+	var walked []string
+	err = c.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		walked = append(walked, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if len(walked) != 4 || walked[1] != "a" || walked[2] != "a/b" || walked[3] != "a/file" {
+		t.Fatalf("unexpected walk %q", walked)
+	}
+	if err := c.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := c.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("directory is not empty: %v", err)
+	}
+}
+
+func TestTransferAuto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftptest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, noSftp := range []bool{false, true} {
+		s := sshtest.NewServer(t, nil)
+		s.NoSftp = noSftp
+		c, err := NewSshConn(s.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.ConnClose()
+
+		tr, err := c.Transfer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, isScp := tr.(scpTransfer); isScp != noSftp {
+			t.Fatalf("unexpected transfer %T", tr)
+		}
+		remote := filepath.Join(dir, "remote")
+		if err := c.UploadContext(context.Background(), src, remote); err != nil {
+			t.Fatal(err)
+		}
+		local := filepath.Join(dir, "local")
+		if err := c.Download(remote, local); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(local, "sub", "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatalf("mode %s is not preserved", info.Mode())
+		}
+		os.RemoveAll(remote)
+		os.RemoveAll(local)
+	}
+
+	s := sshtest.NewServer(t, nil)
+	s.NoSftp = true
+	conf := s.Config()
+	conf.Transfer = common.TransferSFTP
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+	if _, err := c.Transfer(); err == nil {
+		t.Fatal("SFTP transfer without sftp subsystem")
+	}
+}
+
+func TestSftpClientStalled(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	s.StallSftp = true
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.SftpClient()
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		c.ConnClose()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnClose is blocked by the SFTP initialization")
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("SFTP client of closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SFTP initialization is not interrupted")
+	}
+}
@@ -2,95 +2,454 @@ package ssh
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/crypto/ssh"
 	"github.com/dorzheh/infra/comm/common"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrConnBroken = errors.New("ssh connection is broken")
+	ErrConnClosed = errors.New("ssh connection is closed")
 )
 
 type SshConn struct {
 	Client *ssh.Client
+
+	config    *common.Config
+	mu        sync.Mutex
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+	sftp      *sftp.Client
+	// limits concurrent sessions of pooled connections
+	limiter *sessionLimiter
+	// jump hosts the connection is tunneled through
+	hops []*ssh.Client
+	// running port forwards
+	forwards map[*Forward]struct{}
+}
+
+func NewSshConn(c *common.Config) (*SshConn, error) {
+	return NewSshConnContext(context.Background(), c)
 }
 
-func NewSshConn(c *common.Config) (conn *SshConn, err error) {
-	auth := []ssh.AuthMethod{
-		ssh.Password(c.Password),
+// NewSshConnContext connects to the remote host through Config.Proxy
+// and Config.JumpHosts if any.
+// Dial and handshake are aborted once ctx is done or Config.Timeout expires.
+// Nothing is dialed if Config.Transcript is replayed.
+// Transient failures are retried by Config.Retry
+func NewSshConnContext(ctx context.Context, c *common.Config) (*SshConn, error) {
+	if c.Transcript != nil && c.Transcript.Replaying() {
+		return replayConn(c), nil
+	}
+	var conn *SshConn
+	err := c.Retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		conn, err = newSshConnContext(ctx, c)
+		return err
+	})
+	if err != nil {
+		return nil, common.RedactError(err, c.Secrets()...)
+	}
+	return conn, nil
+}
+
+func newSshConnContext(ctx context.Context, c *common.Config) (_ *SshConn, err error) {
+	if c.Timeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+		defer func() {
+			// the attempt is cut by Config.Timeout, not by the caller
+			if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+				err = &timeoutError{err: err, timeout: c.Timeout}
+			}
+		}()
+	}
+	dial, err := proxyDialer(c.Proxy)
+	if err != nil {
+		return nil, err
 	}
-	var key ssh.Signer
-	if _, err = os.Stat(c.PrvtKeyFile); err == nil {
-		key, err = getKey(c.PrvtKeyFile)
+	var hops []*ssh.Client
+	for _, hop := range c.JumpHosts {
+		client, err := dialClient(ctx, dial, hop)
 		if err != nil {
-			return
+			closeClients(hops)
+			return nil, fmt.Errorf("jump host %s: %w", net.JoinHostPort(hop.Host, hop.Port), err)
 		}
-		auth = append(auth, ssh.PublicKeys(key))
+		hops = append(hops, client)
+		dial = client.DialContext
+	}
+	client, err := dialClient(ctx, dial, c)
+	if err != nil {
+		closeClients(hops)
+		return nil, err
+	}
+	conn := newSshConn(client, c)
+	conn.hops = hops
+	return conn, nil
+}
+
+// timeoutError reports the dial or handshake cut by Config.Timeout.
+// Being a timeout net.Error it is retried by Config.Retry
+type timeoutError struct {
+	err     error
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s [timed out after %s]", e.err, e.timeout)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// dialClient connects to the host described by c using dial
+func dialClient(ctx context.Context, dial dialFunc, c *common.Config) (*ssh.Client, error) {
+	auth, agentConn, skipped, err := authMethods(c)
+	if err != nil {
+		return nil, err
 	}
+	// the agent is needed only during the handshake
+	defer agentConn.Close()
 
+	hkCallback, hkAlgos, err := hostKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
 	clientConfig := &ssh.ClientConfig{
-		User: c.User,
-		Auth: auth,
+		User:              c.User,
+		Auth:              auth,
+		HostKeyCallback:   hkCallback,
+		HostKeyAlgorithms: hkAlgos,
 	}
-	var client *ssh.Client
-	// connect to remote host
-	client, err = ssh.Dial("tcp", c.Host+":"+c.Port, clientConfig)
+	addr := net.JoinHostPort(c.Host, c.Port)
+	nConn, err := dial(ctx, "tcp", addr)
 	if err != nil {
-		return
+		return nil, err
 	}
-	conn = &SshConn{Client: client}
-	return
+	client, err := clientHandshake(ctx, nConn, addr, clientConfig)
+	if err != nil && skipped != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		return nil, fmt.Errorf("%w [skipped keys: %w]", err, skipped)
+	}
+	return client, err
 }
 
-func (c *SshConn) ConnClose() {
-	c.Client.Close()
+// closeClients closes the chain of jump hosts, the last hop first
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
 }
 
-func (c *SshConn) Upload(src, dst string) error {
-	stat, err := os.Stat(src)
-	if err != nil {
-		return err
+// clientHandshake runs the SSH handshake over nConn.
+// nConn is closed if the handshake fails or ctx is done
+func clientHandshake(ctx context.Context, nConn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		nConn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			nConn.Close()
+		case <-done:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(nConn, addr, config)
+	close(done)
+	if err == nil {
+		err = ctx.Err()
 	}
-	fd, err := os.Open(src)
 	if err != nil {
-		return err
+		nConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
-	defer fd.Close()
+	nConn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
 
-	session, err := c.Client.NewSession()
-	if err != nil {
+func newSshConn(client *ssh.Client, c *common.Config) *SshConn {
+	conn := &SshConn{Client: client, config: c, done: make(chan struct{})}
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = io.EOF
+		}
+		conn.markBroken(err)
+	}()
+	if c.KeepAliveInterval > 0 {
+		countMax := c.KeepAliveCountMax
+		if countMax <= 0 {
+			countMax = 3
+		}
+		go conn.keepAlive(c.KeepAliveInterval, countMax)
+	}
+	return conn
+}
+
+// keepAlive sends keepalive requests and marks the connection broken
+// once countMax requests in a row are left unanswered
+func (c *SshConn) keepAlive(interval time.Duration, countMax int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := c.Client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-c.done:
+			return
+		case err := <-reply:
+			if err != nil {
+				c.markBroken(err)
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			if missed++; missed >= countMax {
+				c.markBroken(fmt.Errorf("%d keepalive requests unanswered", missed))
+				return
+			}
+		}
+	}
+}
+
+// markBroken closes the client and the port forwards whose
+// connections would fail anyway
+func (c *SshConn) markBroken(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = fmt.Errorf("%w: %s", ErrConnBroken, err)
+	}
+	forwards := c.forwards
+	c.forwards = nil
+	c.mu.Unlock()
+	c.Client.Close()
+	for f := range forwards {
+		f.Close()
+	}
+}
+
+// Err returns nil while the connection is usable.
+// Otherwise it returns ErrConnClosed or an error wrapping ErrConnBroken
+func (c *SshConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Broken reports whether the connection has been lost
+func (c *SshConn) Broken() bool {
+	return errors.Is(c.Err(), ErrConnBroken)
+}
+
+func (c *SshConn) ConnClose() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = ErrConnClosed
+		}
+		sftpClient := c.sftp
+		forwards := c.forwards
+		c.forwards = nil
+		c.mu.Unlock()
+		for f := range forwards {
+			f.Close()
+		}
+		if c.done != nil {
+			close(c.done)
+		}
+		if sftpClient != nil {
+			sftpClient.Close()
+		}
+		if c.Client != nil {
+			c.Client.Close()
+		}
+		closeClients(c.hops)
+	})
+}
+
+// newSession opens a new session unless ctx is done first.
+// The session must be closed by closeSession
+func (c *SshConn) newSession(ctx context.Context) (*ssh.Session, error) {
+	if c.limiter == nil {
+		return c.openSession(ctx)
+	}
+	for {
+		released := c.limiter.releasedChan()
+		if err := c.limiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		session, err := c.openSession(ctx)
+		if err == nil {
+			return session, nil
+		}
+		busy := c.limiter.cancel()
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited || busy == 0 {
+			return nil, err
+		}
+		// the server limits amount of sessions (MaxSessions),
+		// wait for another session to finish
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retry runs fn by Config.Retry.
+// Failures of broken connection are not retried
+func (c *SshConn) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	if c.config == nil || c.config.Retry == nil {
+		return fn(ctx)
+	}
+	return c.config.Retry.Do(ctx, func(ctx context.Context) error {
+		err := fn(ctx)
+		if err != nil && c.Err() != nil {
+			return common.Permanent(err)
+		}
 		return err
+	})
+}
+
+func (c *SshConn) closeSession(session *ssh.Session) {
+	session.Close()
+	if c.limiter != nil {
+		c.limiter.release()
+	}
+}
+
+func (c *SshConn) openSession(ctx context.Context) (*ssh.Session, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.offline(); err != nil {
+		return nil, err
 	}
-	defer session.Close()
+	type result struct {
+		session *ssh.Session
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		session, err := c.Client.NewSession()
+		ch <- result{session, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			if err := c.Err(); err != nil {
+				return nil, err
+			}
+		}
+		return r.session, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.session != nil {
+				r.session.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// runSession runs cmd in the session.If ctx is done first, the remote
+// command is sent SIGTERM and the session is closed
+func runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	errc := make(chan error, 1)
 	go func() {
-		w, _ := session.StdinPipe()
-		defer w.Close()
-		fmt.Fprintln(w, "C0644", stat.Size(), filepath.Base(dst))
-		io.Copy(w, fd)
-		fmt.Fprint(w, "\x00")
+		errc <- session.Run(cmd)
 	}()
-	cmd := "scp  -qrt " + filepath.Dir(dst)
-	return session.Run(cmd)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+		return ctx.Err()
+	}
 }
 
 // Returns output from descryptors 1(result output) and 2( error output) and  error/nil
 func (c *SshConn) Run(cmd string) (string, string, error) {
+	return c.RunContext(context.Background(), cmd)
+}
+
+// RunContext is like Run but terminates the remote command once ctx is done
+func (c *SshConn) RunContext(ctx context.Context, cmd string) (string, string, error) {
+	res, err := c.ExecContext(ctx, cmd)
+	if res == nil {
+		return "", "", err
+	}
+	return res.Stdout, res.Stderr, err
+}
+
+// Exec runs the command and returns its result.
+// A command exited with non-zero status yields *common.ExitError
+func (c *SshConn) Exec(cmd string) (*common.Result, error) {
+	return c.ExecContext(context.Background(), cmd)
+}
+
+// ExecContext is like Exec but terminates the remote command once ctx is done
+func (c *SshConn) ExecContext(ctx context.Context, cmd string) (*common.Result, error) {
 	var outputBuffer bytes.Buffer
 	var errorBuffer bytes.Buffer
 
-	session, err := c.Client.NewSession()
-	if err != nil {
-		return "", "", err
+	res, err := c.StreamContext(ctx, cmd, nil, &outputBuffer, &errorBuffer)
+	if res == nil || ctx.Err() != nil {
+		// the buffers may still be written by the session
+		return res, err
 	}
-	defer session.Close()
+	res.Stdout = outputBuffer.String()
+	res.Stderr = errorBuffer.String()
+	return res, err
+}
 
-	session.Stdout = &outputBuffer
-	session.Stderr = &errorBuffer
-	if err := session.Run(cmd); err != nil {
-		return "", errorBuffer.String(), err
+// exitError fills exit status of the result and converts
+// ssh exit errors to *common.ExitError
+func exitError(res *common.Result, err error) error {
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case errors.As(err, &exitErr):
+		res.ExitStatus = exitErr.ExitStatus()
+		if exitErr.Signal() != "" {
+			res.ExitStatus = -1
+			res.Signal = exitErr.Signal()
+		}
+		return &common.ExitError{Result: res}
+	case errors.As(err, &missingErr):
+		res.ExitStatus = -1
+		return &common.ExitError{Result: res}
+	case err != nil:
+		res.ExitStatus = -1
 	}
-	return outputBuffer.String(), "", nil
+	return err
 }
 
 func getKey(pathToKeyFile string) (key ssh.Signer, err error) {
@@ -1,18 +1,25 @@
 package ssh
 
 import (
+	"context"
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
 )
 
 func TestRun(t *testing.T) {
 	conf := &common.Config{
-		Host:        "127.0.0.1",
-		Port:        "22",
-		User:        "test",
-		Password:    "test",
-		PrvtKeyFile: "",
+		Host:          "127.0.0.1",
+		Port:          "22",
+		User:          "test",
+		Password:      "test",
+		PrvtKeyFile:   "",
+		HostKeyPolicy: common.HostKeyTOFU,
 	}
 	c, err := NewSshConn(conf)
 	if err != nil {
@@ -26,3 +33,177 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRunContextCancel(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := c.RunContext(ctx, "sleep 10"); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("RunContext was not interrupted")
+	}
+	// the connection is still usable
+	if out, _, err := c.Run("echo ok"); err != nil || out != "ok\n" {
+		t.Fatalf("unexpected result %q: %v", out, err)
+	}
+}
+
+func TestKeepAliveBroken(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	conf := s.Config()
+	conf.KeepAliveInterval = 50 * time.Millisecond
+	c, err := NewSshConn(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+	if c.Broken() {
+		t.Fatal("new connection is broken")
+	}
+	s.DropConnections()
+	for i := 0; !c.Broken(); i++ {
+		if i == 100 {
+			t.Fatal("broken connection not detected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, _, err := c.Run("true"); !errors.Is(err, ErrConnBroken) {
+		t.Fatalf("expected ErrConnBroken, got %v", err)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ConnClose()
+	c.ConnClose()
+	if err := c.Err(); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+	if _, _, err := c.Client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatal("client is not closed")
+	}
+}
+
+func TestExecExitStatus(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	res, err := c.Exec("echo out; echo err >&2; exit 3")
+	var exitErr *common.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected ExitError, got %v", err)
+	}
+	if exitErr.ExitCode() != 3 || res.Stdout != "out\n" || res.Stderr != "err\n" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res, err = c.Exec("true"); err != nil || !res.Success() {
+		t.Fatalf("unexpected result %+v: %v", res, err)
+	}
+}
+
+func TestStreamLines(t *testing.T) {
+	s := sshtest.NewServer(t, nil)
+	c, err := NewSshConn(s.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ConnClose()
+
+	var lines []string
+	stdin := strings.NewReader("one\ntwo\nthree")
+	res, err := c.StreamLines(context.Background(), "cat", stdin, func(line string) {
+		lines = append(lines, line)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() || strings.Join(lines, ",") != "one,two,three" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	// nothing listens on the port once the listener is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	var retries int
+	conf := &common.Config{Host: host, Port: port, User: "test", Password: "test",
+		HostKeyPolicy: common.HostKeyInsecure,
+		Retry: &common.RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: time.Millisecond,
+			OnRetry:      func(int, error, time.Duration) { retries++ },
+		},
+	}
+	_, err = NewSshConn(conf)
+	var retryErr *common.RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 3 || retries != 2 {
+		t.Fatalf("expected 3 attempts, got %v", err)
+	}
+
+	// attempts cut by the timeout are retried
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accepts but never answers the handshake
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	host, port, _ = net.SplitHostPort(l.Addr().String())
+	retries = 0
+	conf.Host, conf.Port = host, port
+	conf.Timeout = 100 * time.Millisecond
+	_, err = NewSshConn(conf)
+	var netErr net.Error
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 3 || retries != 2 {
+		t.Fatalf("expected 3 attempts, got %v", err)
+	}
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// authentication failures are not retried
+	s := sshtest.NewServer(t, nil)
+	conf = s.Config()
+	conf.Password = "wrong"
+	conf.Retry = &common.RetryPolicy{InitialDelay: time.Millisecond}
+	if _, err := NewSshConn(conf); err == nil || errors.As(err, &retryErr) {
+		t.Fatalf("expected single failed attempt, got %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Package sshtest provides in-process SSH server for tests
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/pty"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is a minimal in-process SSH server executing
+// commands with the local shell
+type Server struct {
+	HostKey ssh.PublicKey
+	// reject the sftp subsystem
+	NoSftp bool
+	// accept the sftp subsystem but never answer
+	StallSftp bool
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// NewServer starts a server on a random local port.
+// If config is nil, user "test" with password "test" is accepted
+func NewServer(t testing.TB, config *ssh.ServerConfig) *Server {
+	if config == nil {
+		config = &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				if c.User() == "test" && string(pass) == "test" {
+					return nil, nil
+				}
+				return nil, ErrAuth
+			},
+		}
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{listener: l, config: config, HostKey: signer.PublicKey()}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// ErrAuth is returned by the default password callback
+var ErrAuth = errors.New("access denied")
+
+func (s *Server) close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Config returns client configuration pinned to the server host key
+func (s *Server) Config() *common.Config {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &common.Config{
+		Host:               host,
+		Port:               port,
+		User:               "test",
+		Password:           "test",
+		HostKeyPolicy:      common.HostKeyFingerprint,
+		HostKeyFingerprint: ssh.FingerprintSHA256(s.HostKey),
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(nConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		nConn.Close()
+		return
+	}
+	defer conn.Close()
+	// remote forwards of the client
+	forwards := make(map[string]net.Listener)
+	var forwardsMu sync.Mutex
+	defer func() {
+		forwardsMu.Lock()
+		for _, l := range forwards {
+			l.Close()
+		}
+		forwardsMu.Unlock()
+	}()
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				forwardsMu.Lock()
+				s.tcpipForward(conn, req, forwards)
+				forwardsMu.Unlock()
+			case "cancel-tcpip-forward":
+				var payload struct {
+					Addr string
+					Port uint32
+				}
+				ssh.Unmarshal(req.Payload, &payload)
+				key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+				forwardsMu.Lock()
+				l, ok := forwards[key]
+				delete(forwards, key)
+				forwardsMu.Unlock()
+				if ok {
+					l.Close()
+				}
+				req.Reply(ok, nil)
+			default:
+				if req.WantReply {
+					req.Reply(req.Type == "keepalive@openssh.com", nil)
+				}
+			}
+		}
+	}()
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			ch, chReqs, err := newChan.Accept()
+			if err != nil {
+				continue
+			}
+			go s.handleSession(ch, chReqs)
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// tcpipForward listens on the requested address and forwards accepted
+// connections to the client
+func (s *Server) tcpipForward(conn *ssh.ServerConn, req *ssh.Request, forwards map[string]net.Listener) {
+	var payload struct {
+		Addr string
+		Port uint32
+	}
+	ssh.Unmarshal(req.Payload, &payload)
+	l, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	forwards[net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))] = l
+	req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)}))
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go pipe(ch, c)
+		}
+	}()
+}
+
+// handleDirectTCPIP forwards the channel to the requested address
+func (s *Server) handleDirectTCPIP(newChan ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, conn)
+}
+
+func (s *Server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	// pseudo-terminal requested by the client
+	var term *pty.Pty
+	var termSize struct{ Columns, Rows uint32 }
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var payload struct {
+				Term          string
+				Columns, Rows uint32
+				Width, Height uint32
+				Modes         string
+			}
+			ssh.Unmarshal(req.Payload, &payload)
+			termSize.Columns, termSize.Rows = payload.Columns, payload.Rows
+			req.Reply(true, nil)
+			// allocated once the command is started
+			term = &pty.Pty{}
+		case "window-change":
+			ssh.Unmarshal(req.Payload, &termSize)
+			if term != nil && term.File != nil {
+				term.Resize(int(termSize.Columns), int(termSize.Rows))
+			}
+		case "exec", "shell":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if req.Type == "shell" {
+				cmd = exec.Command("/bin/sh", "-i")
+			} else {
+				cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			}
+			if term != nil {
+				t, err := pty.Start(cmd)
+				if err != nil {
+					req.Reply(false, nil)
+					ch.Close()
+					return
+				}
+				term = t
+				term.Resize(int(termSize.Columns), int(termSize.Rows))
+				req.Reply(true, nil)
+				go io.Copy(term, ch)
+				go func() {
+					io.Copy(ch, term)
+					cmd.Wait()
+					term.Close()
+					s.sendExitStatus(ch, cmd)
+				}()
+				continue
+			}
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			// like sshd, do not wait for the client to close stdin
+			stdin, _ := cmd.StdinPipe()
+			if err := cmd.Start(); err != nil {
+				req.Reply(false, nil)
+				ch.Close()
+				return
+			}
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			go func() {
+				cmd.Wait()
+				s.sendExitStatus(ch, cmd)
+			}()
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" || s.NoSftp {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			if s.StallSftp {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				server, err := sftp.NewServer(ch)
+				if err != nil {
+					return
+				}
+				server.Serve()
+			}()
+		case "signal":
+			if cmd != nil {
+				cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) sendExitStatus(ch ssh.Channel, cmd *exec.Cmd) {
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(cmd.ProcessState.ExitCode()))
+	ch.SendRequest("exit-status", false, status)
+	ch.Close()
+}
+
+// DropConnections closes all client connections without
+// stopping the server
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// pipe copies data both ways until either side is closed
+func pipe(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyClose := func(dst io.WriteCloser, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyClose(a, b)
+	go copyClose(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
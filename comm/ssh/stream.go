@@ -0,0 +1,168 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/utils/ioutils"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxLineLength limits the amount of data buffered by a line writer.
+// Longer lines are passed to the callback in chunks
+const maxLineLength = 64 * 1024
+
+// Stream runs the command feeding it from stdin and copying its output
+// to stdout and stderr as it arrives.Any of them may be nil.
+// Stdout and Stderr of the returned result are always empty
+func (c *SshConn) Stream(cmd string, stdin io.Reader, stdout, stderr io.Writer) (*common.Result, error) {
+	return c.StreamContext(context.Background(), cmd, stdin, stdout, stderr)
+}
+
+// StreamContext is like Stream but terminates the remote command once ctx is done.
+// In that case the writers may still be written for a short while after return
+func (c *SshConn) StreamContext(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*common.Result, error) {
+	switch {
+	case c.dryRun():
+		common.LogDryRun(c.config.DryRun, c.host(), "run", cmd)
+		return &common.Result{Command: cmd}, nil
+	case c.replaying():
+		res, err := c.config.Transcript.Replay(c.host(), "run", cmd)
+		if res != nil {
+			if stdout != nil {
+				io.WriteString(stdout, res.Stdout)
+			}
+			if stderr != nil {
+				io.WriteString(stderr, res.Stderr)
+			}
+			res.Stdout, res.Stderr = "", ""
+		}
+		return res, err
+	case c.recording():
+		return c.streamRecorded(ctx, cmd, stdin, stdout, stderr)
+	}
+	return c.stream(ctx, cmd, stdin, stdout, stderr)
+}
+
+// streamRecorded runs the command recording its output to the transcript
+func (c *SshConn) streamRecorded(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*common.Result, error) {
+	if stdout != nil && stdout == stderr {
+		w := &ioutils.SyncWriter{W: stdout}
+		stdout, stderr = w, w
+	}
+	var outBuf, errBuf bytes.Buffer
+	res, err := c.stream(ctx, cmd, stdin, ioutils.TeeBuffer(stdout, &outBuf), ioutils.TeeBuffer(stderr, &errBuf))
+	if res == nil {
+		c.record("run", []string{cmd}, nil, err)
+		return res, err
+	}
+	recorded := *res
+	if ctx.Err() == nil {
+		// the buffers may still be written by the session otherwise
+		recorded.Stdout, recorded.Stderr = outBuf.String(), errBuf.String()
+	}
+	c.record("run", []string{cmd}, &recorded, err)
+	return res, err
+}
+
+func (c *SshConn) stream(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (*common.Result, error) {
+	var session *ssh.Session
+	err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		session, err = c.newSession(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeSession(session)
+
+	// the session copies stdout and stderr concurrently
+	if stdout != nil && stdout == stderr {
+		w := &ioutils.SyncWriter{W: stdout}
+		stdout, stderr = w, w
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	start := time.Now()
+	err = runSession(ctx, session, cmd)
+	res := &common.Result{Command: cmd, Duration: time.Since(start)}
+	if ctx.Err() != nil {
+		res.ExitStatus = -1
+		return res, err
+	}
+	return res, exitError(res, err)
+}
+
+// StreamLines runs the command and calls onStdout and onStderr for every
+// line (without the trailing newline) of the appropriate output
+func (c *SshConn) StreamLines(ctx context.Context, cmd string, stdin io.Reader, onStdout, onStderr func(line string)) (*common.Result, error) {
+	var stdout, stderr io.WriteCloser
+	if onStdout != nil {
+		stdout = NewLineWriter(onStdout)
+	}
+	if onStderr != nil {
+		stderr = NewLineWriter(onStderr)
+	}
+	res, err := c.StreamContext(ctx, cmd, stdin, writer(stdout), writer(stderr))
+	if ctx.Err() == nil {
+		// flush the last unterminated lines
+		if stdout != nil {
+			stdout.Close()
+		}
+		if stderr != nil {
+			stderr.Close()
+		}
+	}
+	return res, err
+}
+
+// writer avoids passing a typed nil as io.Writer
+func writer(w io.WriteCloser) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return w
+}
+
+type lineWriter struct {
+	fn  func(string)
+	buf bytes.Buffer
+}
+
+// NewLineWriter returns a writer calling fn for every line written.
+// Close passes the remaining unterminated line to fn
+func NewLineWriter(fn func(line string)) io.WriteCloser {
+	return &lineWriter{fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.buf.Write(p)
+			for w.buf.Len() >= maxLineLength {
+				w.fn(string(w.buf.Next(maxLineLength)))
+			}
+			break
+		}
+		w.buf.Write(p[:i])
+		w.fn(w.buf.String())
+		w.buf.Reset()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (w *lineWriter) Close() error {
+	if w.buf.Len() > 0 {
+		w.fn(w.buf.String())
+		w.buf.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ssh
+
+import (
+	"context"
+	"io"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+// Transfer copies files between local and remote hosts
+type Transfer interface {
+	Upload(ctx context.Context, src, dst string, opts *TransferOptions) error
+	Download(ctx context.Context, src, dst string, opts *TransferOptions) error
+}
+
+// ProgressFunc is called while a file is being transferred
+type ProgressFunc func(file string, transferred, total int64)
+
+// TransferOptions configures file transfers
+type TransferOptions struct {
+	// preserve modification and access times
+	PreserveTimes bool
+	Progress      ProgressFunc
+}
+
+var defaultTransferOptions = &TransferOptions{PreserveTimes: true}
+
+// Upload copies local file or directory src (recursively) to the remote
+// path dst.Modes and times are preserved
+func (c *SshConn) Upload(src, dst string) error {
+	return c.UploadContext(context.Background(), src, dst)
+}
+
+// UploadContext is like Upload but aborts once ctx is done.
+// Transient failures are retried by Config.Retry
+func (c *SshConn) UploadContext(ctx context.Context, src, dst string) error {
+	return c.retry(ctx, func(ctx context.Context) error {
+		t, err := c.Transfer()
+		if err != nil {
+			return err
+		}
+		return t.Upload(ctx, src, dst, defaultTransferOptions)
+	})
+}
+
+// Download copies remote file or directory src (recursively) to the local
+// path dst.If dst is an existing directory, src is placed inside it
+func (c *SshConn) Download(src, dst string) error {
+	return c.DownloadContext(context.Background(), src, dst)
+}
+
+// DownloadContext is like Download but aborts once ctx is done.
+// Transient failures are retried by Config.Retry
+func (c *SshConn) DownloadContext(ctx context.Context, src, dst string) error {
+	return c.retry(ctx, func(ctx context.Context) error {
+		t, err := c.Transfer()
+		if err != nil {
+			return err
+		}
+		return t.Download(ctx, src, dst, defaultTransferOptions)
+	})
+}
+
+// Transfer returns the transfer implementation selected by Config.Transfer.
+// In auto mode SFTP is used if the server provides it
+func (c *SshConn) Transfer() (Transfer, error) {
+	mode := common.TransferAuto
+	if c.config != nil {
+		mode = c.config.Transfer
+	}
+	if c.Client == nil {
+		// replayed, the transfers are answered by the transcript
+		return c.SftpTransfer(), nil
+	}
+	switch mode {
+	case common.TransferSCP:
+		return c.ScpTransfer(), nil
+	case common.TransferSFTP:
+		if _, err := c.SftpClient(); err != nil {
+			return nil, err
+		}
+		return c.SftpTransfer(), nil
+	}
+	if _, err := c.SftpClient(); err != nil {
+		if cerr := c.Err(); cerr != nil {
+			return nil, cerr
+		}
+		return c.ScpTransfer(), nil
+	}
+	return c.SftpTransfer(), nil
+}
+
+// ScpTransfer returns Transfer implemented by SCP
+func (c *SshConn) ScpTransfer() Transfer {
+	return scpTransfer{c}
+}
+
+// SftpTransfer returns Transfer implemented by SFTP
+func (c *SshConn) SftpTransfer() Transfer {
+	return sftpTransfer{c}
+}
+
+type scpTransfer struct {
+	c *SshConn
+}
+
+func (t scpTransfer) Upload(ctx context.Context, src, dst string, opts *TransferOptions) error {
+	return t.c.ScpUpload(ctx, src, dst, opts)
+}
+
+func (t scpTransfer) Download(ctx context.Context, src, dst string, opts *TransferOptions) error {
+	return t.c.ScpDownload(ctx, src, dst, opts)
+}
+
+type sftpTransfer struct {
+	c *SshConn
+}
+
+func (t sftpTransfer) Upload(ctx context.Context, src, dst string, opts *TransferOptions) error {
+	return t.c.SftpUpload(ctx, src, dst, opts)
+}
+
+func (t sftpTransfer) Download(ctx context.Context, src, dst string, opts *TransferOptions) error {
+	return t.c.SftpDownload(ctx, src, dst, opts)
+}
+
+// progressOf wraps w reporting progress of the file if requested
+func progressOf(w io.Writer, file string, total int64, opts *TransferOptions) io.Writer {
+	if opts.Progress == nil {
+		return w
+	}
+	return &progressWriter{w: w, file: file, total: total, fn: opts.Progress}
+}
+
+type progressWriter struct {
+	w           io.Writer
+	file        string
+	transferred int64
+	total       int64
+	fn          ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.transferred += int64(n)
+	p.fn(p.file, p.transferred, p.total)
+	return n, err
+}
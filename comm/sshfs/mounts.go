@@ -0,0 +1,222 @@
+package sshfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dorzheh/infra/utils/fsutils"
+)
+
+// MountTimeout is max wait for the share to show up in the mount table
+var MountTimeout = 10 * time.Second
+
+var ErrMountpointBusy = errors.New("another file system is mounted at the mountpoint")
+
+// DetachMode selects how the share is unmounted
+type DetachMode int
+
+const (
+	// fails if the share is busy
+	DetachNormal DetachMode = iota
+	// detach now, clean up once the share is not busy anymore
+	DetachLazy
+	// abort pending requests (requires root)
+	DetachForce
+)
+
+// Mount is a share attached by the process
+type Mount struct {
+	// [user@]host:path
+	Remote     string
+	Mountpoint string
+	fusermount string
+}
+
+var mounts = struct {
+	sync.Mutex
+	m map[string]*Mount
+}{m: make(map[string]*Mount)}
+
+// Mounts returns the shares attached by the process and not detached yet
+// ordered by the mountpoint
+func Mounts() []*Mount {
+	mounts.Lock()
+	defer mounts.Unlock()
+	list := make([]*Mount, 0, len(mounts.m))
+	for _, m := range mounts.m {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Mountpoint < list[j].Mountpoint })
+	return list
+}
+
+// DetachAll lazily detaches all the shares attached by the process.
+// Suits utils.Shutdown:
+//
+//	shutdown.AddFunc("sshfs", sshfs.DetachAll)
+func DetachAll() error {
+	var errs []string
+	for _, m := range Mounts() {
+		if err := DetachMount(m.Mountpoint, m.fusermount, DetachLazy); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RemoteSpec returns [user@]host:path, IPv6 addresses are bracketed
+func RemoteSpec(user, host, path string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if user != "" {
+		host = user + "@" + host
+	}
+	return host + ":" + path
+}
+
+// parseRemote splits [user@]host:path
+func parseRemote(spec string) (user, host, p string, ok bool) {
+	if u, rest, found := strings.Cut(spec, "@"); found && !strings.ContainsAny(u, ":/") {
+		user, spec = u, rest
+	}
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]:")
+		if end < 0 {
+			return "", "", "", false
+		}
+		return user, spec[1:end], spec[end+2:], true
+	}
+	host, p, ok = strings.Cut(spec, ":")
+	return user, host, p, ok
+}
+
+// sameShare reports whether the mount source is the remote share.
+// The source may be prefixed by the program ("sshfs#user@host:path")
+func sameShare(source, remote string) bool {
+	if prog, spec, found := strings.Cut(source, "#"); found && !strings.ContainsAny(prog, ":@") {
+		source = spec
+	}
+	if source == remote {
+		return true
+	}
+	su, sh, sp, ok := parseRemote(source)
+	if !ok {
+		return false
+	}
+	ru, rh, rp, ok := parseRemote(remote)
+	return ok && su == ru && sh == rh && path.Clean(sp) == path.Clean(rp)
+}
+
+// mountpointPath returns the absolute path as listed in /proc/mounts
+func mountpointPath(mountpoint string) (string, error) {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// AttachMount calls mount to mount the remote share at mountpoint and
+// waits for it to show up in the mount table.
+// Nothing is done if the share is already mounted there, the mountpoint
+// is created if missing.
+// A stale mount of the share (transport endpoint is not connected)
+// is detached and mounted again
+func AttachMount(remote, mountpoint, fusermount string, mount func(mountpoint string) error) error {
+	mp, err := mountpointPath(mountpoint)
+	if err != nil {
+		return err
+	}
+	source, mounted, err := fsutils.MountSource(mp)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if !sameShare(source, remote) {
+			return fmt.Errorf("%s: %w (%s)", mp, ErrMountpointBusy, source)
+		}
+		if _, err := os.Stat(mp); !errors.Is(err, syscall.ENOTCONN) {
+			return nil
+		}
+		if err := DetachMount(mp, fusermount, DetachLazy); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(mp, 0755); err != nil {
+		return err
+	}
+	if err := mount(mp); err != nil {
+		return err
+	}
+	if err := waitMounted(mp); err != nil {
+		return err
+	}
+	mounts.Lock()
+	mounts.m[mp] = &Mount{Remote: remote, Mountpoint: mp, fusermount: fusermount}
+	mounts.Unlock()
+	return nil
+}
+
+func waitMounted(mp string) error {
+	deadline := time.Now().Add(MountTimeout)
+	for {
+		mounted, err := fsutils.Mounted("", mp)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: not mounted after %s", mp, MountTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// DetachMount unmounts the share at mountpoint by fusermount.
+// Nothing is done if nothing is mounted there
+func DetachMount(mountpoint, fusermount string, mode DetachMode) error {
+	mp, err := mountpointPath(mountpoint)
+	if err != nil {
+		return err
+	}
+	mounted, err := fsutils.Mounted("", mp)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		var cmd *exec.Cmd
+		switch mode {
+		case DetachLazy:
+			cmd = exec.Command(fusermount, "-u", "-z", mp)
+		case DetachForce:
+			cmd = exec.Command("umount", "-f", mp)
+		default:
+			cmd = exec.Command(fusermount, "-u", mp)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s [%s]", out, err)
+		}
+	}
+	mounts.Lock()
+	delete(mounts.m, mp)
+	mounts.Unlock()
+	return nil
+}
@@ -0,0 +1,97 @@
+package sshfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/utils/fsutils"
+)
+
+func TestAttachMounted(t *testing.T) {
+	source, mounted, err := fsutils.MountSource("/proc")
+	if err != nil || !mounted {
+		t.Skip("/proc is not mounted")
+	}
+	noMount := func(string) error {
+		t.Fatal("mount must not be called")
+		return nil
+	}
+	// the same source is already mounted there
+	if err := AttachMount(source, "/proc", "fusermount", noMount); err != nil {
+		t.Fatal(err)
+	}
+	if err := AttachMount("user@host:/share", "/proc", "fusermount", noMount); !errors.Is(err, ErrMountpointBusy) {
+		t.Fatalf("expected ErrMountpointBusy, got %v", err)
+	}
+	if len(Mounts()) != 0 {
+		t.Fatal("mounts of others must not be tracked")
+	}
+}
+
+func TestAttachTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshfstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration) { MountTimeout = timeout }(MountTimeout)
+	MountTimeout = 200 * time.Millisecond
+
+	mp := filepath.Join(dir, "a", "mnt")
+	called := ""
+	err = AttachMount("user@host:/share", mp, "fusermount", func(mountpoint string) error {
+		called = mountpoint
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	if info, err := os.Stat(mp); err != nil || !info.IsDir() {
+		t.Fatalf("mountpoint is not created: %v", err)
+	}
+	if resolved, _ := filepath.EvalSymlinks(mp); called != resolved {
+		t.Fatalf("mount called with %q, want %q", called, resolved)
+	}
+	if len(Mounts()) != 0 {
+		t.Fatal("failed mounts must not be tracked")
+	}
+	// not mounted
+	if err := DetachMount(mp, "fusermount", DetachLazy); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSameShare(t *testing.T) {
+	for _, tt := range []struct {
+		source, remote string
+		same           bool
+	}{
+		{"sshfs#user@host:/share", "user@host:/share", true},
+		{"user@host:/share/", "user@host:/share", true},
+		{"sshfs#user@[::1]:/share", "user@[::1]:/share", true},
+		{"sshfs#host:dir", "host:dir", true},
+		{"proc", "proc", true},
+		{"sshfs#user@host:/srv/data", "user@host:/data", false},
+		{"sshfs#user@otherhost:/share", "user@host:/share", false},
+		{"sshfs#other@host:/share", "user@host:/share", false},
+		{"sshfs#user@host:/share", "host:/share", false},
+		{"proc", "user@host:/share", false},
+	} {
+		if same := sameShare(tt.source, tt.remote); same != tt.same {
+			t.Errorf("%q %q: got %t", tt.source, tt.remote, same)
+		}
+	}
+}
+
+func TestRemoteSpec(t *testing.T) {
+	if s := RemoteSpec("user", "::1", "/share"); s != "user@[::1]:/share" {
+		t.Fatal(s)
+	}
+	if s := RemoteSpec("", "host", "dir"); s != "host:dir" {
+		t.Fatal(s)
+	}
+}
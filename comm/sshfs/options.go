@@ -0,0 +1,177 @@
+package sshfs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+// FuseVersion is major version of the FUSE userspace installed
+type FuseVersion int
+
+const (
+	Fuse2 FuseVersion = 2
+	Fuse3 FuseVersion = 3
+)
+
+// DetectFuse returns FUSE version installed and path to its fusermount.
+// fusermount3 is shipped by fuse3 only
+func DetectFuse() (FuseVersion, string, error) {
+	if path, err := exec.LookPath("fusermount3"); err == nil {
+		return Fuse3, path, nil
+	}
+	if path, err := exec.LookPath("fusermount"); err == nil {
+		return Fuse2, path, nil
+	}
+	return 0, "", errors.New("neither fusermount3 nor fusermount found")
+}
+
+// Owner the files are shown as owned by
+type Owner struct {
+	UID int
+	GID int
+}
+
+// Options are sshfs mount options ("-o").
+// Options not supported by the FUSE version are translated or dropped
+type Options struct {
+	// ssh ciphers ("aes128-ctr,chacha20-poly1305@openssh.com"),
+	// ssh defaults if empty
+	Ciphers string
+	// ssh compression
+	Compression bool
+	// reconnect to the server once the connection is broken
+	Reconnect bool
+	// interval of ssh keepalives detecting broken connection
+	// (not sent if zero)
+	ServerAliveInterval time.Duration
+	// "none", "user" or "file" (with UIDFile and GIDFile)
+	IDMap   string
+	UIDFile string
+	GIDFile string
+	// show the files as owned by the owner
+	Owner *Owner
+	// access by other users and by root.Need user_allow_other
+	// in /etc/fuse.conf unless mounted by root
+	AllowOther bool
+	AllowRoot  bool
+	// allow mounting over non-empty directory (always allowed by fuse3)
+	NonEmpty bool
+	// convert absolute symlinks to relative
+	TransformSymlinks bool
+	// disable the directory cache
+	NoCache bool
+	// directory cache timeout (sshfs default if zero)
+	CacheTimeout time.Duration
+	// "yes", "no" or "accept-new".
+	// Derived from HostKeyPolicy of the common config if empty
+	StrictHostKeyChecking string
+	// passed as is
+	Extra []string
+}
+
+// DefaultOptions are used if Config.Options is nil
+func DefaultOptions() *Options {
+	return &Options{
+		Reconnect:           true,
+		ServerAliveInterval: 15 * time.Second,
+		IDMap:               "user",
+		TransformSymlinks:   true,
+	}
+}
+
+// list returns the mount options for the FUSE version and the host
+func (o *Options) list(fuse FuseVersion, c *common.Config) []string {
+	var opts []string
+	add := func(format string, args ...interface{}) {
+		opts = append(opts, fmt.Sprintf(format, args...))
+	}
+	if c.Port != "" {
+		add("port=%s", c.Port)
+	}
+	if o.Ciphers != "" {
+		add("Ciphers=%s", o.Ciphers)
+	}
+	if o.Compression {
+		add("compression=yes")
+	} else {
+		add("compression=no")
+	}
+	if o.Reconnect {
+		add("reconnect")
+	}
+	if o.ServerAliveInterval > 0 {
+		add("ServerAliveInterval=%d", int(o.ServerAliveInterval/time.Second))
+	}
+	if o.IDMap != "" {
+		add("idmap=%s", o.IDMap)
+	}
+	if o.UIDFile != "" {
+		add("uidfile=%s", o.UIDFile)
+	}
+	if o.GIDFile != "" {
+		add("gidfile=%s", o.GIDFile)
+	}
+	if o.Owner != nil {
+		add("uid=%d", o.Owner.UID)
+		add("gid=%d", o.Owner.GID)
+	}
+	if o.AllowOther {
+		add("allow_other")
+	}
+	if o.AllowRoot {
+		add("allow_root")
+	}
+	if o.NonEmpty && fuse == Fuse2 {
+		// fuse3 rejects the option
+		add("nonempty")
+	}
+	if o.TransformSymlinks {
+		add("transform_symlinks")
+	}
+	// sshfs 3 (fuse3) renamed the cache options
+	if o.NoCache {
+		if fuse == Fuse3 {
+			add("dir_cache=no")
+		} else {
+			add("cache=no")
+		}
+	}
+	if o.CacheTimeout > 0 {
+		if fuse == Fuse3 {
+			add("dcache_timeout=%d", int(o.CacheTimeout/time.Second))
+		} else {
+			add("cache_timeout=%d", int(o.CacheTimeout/time.Second))
+		}
+	}
+	strict := o.StrictHostKeyChecking
+	if strict == "" {
+		switch c.HostKeyPolicy {
+		case common.HostKeyInsecure:
+			strict = "no"
+			add("UserKnownHostsFile=/dev/null")
+		case common.HostKeyTOFU:
+			strict = "accept-new"
+		default:
+			// ssh cannot pin fingerprints, the known hosts are checked instead
+			strict = "yes"
+		}
+	}
+	add("StrictHostKeyChecking=%s", strict)
+	if c.KnownHostsFile != "" && strict != "no" {
+		add("UserKnownHostsFile=%s", c.KnownHostsFile)
+	}
+	if c.PrvtKeyFile != "" {
+		add("IdentityFile=%s", c.PrvtKeyFile)
+	}
+	return append(opts, o.Extra...)
+}
+
+// MountOption returns the options as "-o" argument
+func (o *Options) MountOption(fuse FuseVersion, c *common.Config) string {
+	return strings.Join(o.list(fuse, c), ",")
+}
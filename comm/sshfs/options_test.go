@@ -0,0 +1,74 @@
+package sshfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/comm/common"
+)
+
+func TestMountOption(t *testing.T) {
+	c := &common.Config{Port: "2222", PrvtKeyFile: "/keys/id"}
+	opts := DefaultOptions()
+	opts.NonEmpty = true
+	opts.NoCache = true
+	opts.Owner = &Owner{UID: 0, GID: 100}
+	opts.Extra = []string{"follow_symlinks"}
+
+	want := "port=2222,compression=no,reconnect,ServerAliveInterval=15,idmap=user,uid=0,gid=100,nonempty,transform_symlinks,cache=no,StrictHostKeyChecking=yes,IdentityFile=/keys/id,follow_symlinks"
+	if got := opts.MountOption(Fuse2, c); got != want {
+		t.Errorf("fuse2:\n got %s\nwant %s", got, want)
+	}
+	want = "port=2222,compression=no,reconnect,ServerAliveInterval=15,idmap=user,uid=0,gid=100,transform_symlinks,dir_cache=no,StrictHostKeyChecking=yes,IdentityFile=/keys/id,follow_symlinks"
+	if got := opts.MountOption(Fuse3, c); got != want {
+		t.Errorf("fuse3:\n got %s\nwant %s", got, want)
+	}
+
+	opts = &Options{Ciphers: "aes128-ctr", Compression: true, CacheTimeout: time.Minute}
+	c = &common.Config{HostKeyPolicy: common.HostKeyInsecure}
+	want = "Ciphers=aes128-ctr,compression=yes,dcache_timeout=60,UserKnownHostsFile=/dev/null,StrictHostKeyChecking=no"
+	if got := opts.MountOption(Fuse3, c); got != want {
+		t.Errorf("insecure:\n got %s\nwant %s", got, want)
+	}
+	c = &common.Config{HostKeyPolicy: common.HostKeyTOFU, KnownHostsFile: "/tmp/known_hosts"}
+	want = "compression=no,StrictHostKeyChecking=accept-new,UserKnownHostsFile=/tmp/known_hosts"
+	if got := (&Options{}).MountOption(Fuse3, c); got != want {
+		t.Errorf("tofu:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestDetectFuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshfstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	if _, _, err := DetectFuse(); err == nil {
+		t.Fatal("expected error without fusermount")
+	}
+	for _, tc := range []struct {
+		file    string
+		version FuseVersion
+	}{
+		{"fusermount", Fuse2},
+		{"fusermount3", Fuse3},
+	} {
+		path := filepath.Join(dir, tc.file)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		version, fusermount, err := DetectFuse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != tc.version || fusermount != path {
+			t.Fatalf("got %d %s, want %d %s", version, fusermount, tc.version, path)
+		}
+	}
+}
@@ -1,18 +1,23 @@
 package sshfs
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
 
 	"github.com/dorzheh/infra/comm/common"
-	"github.com/dorzheh/infra/utils/ioutils"
+	"github.com/dorzheh/infra/comm/remotefs"
 )
 
 type Config struct {
 	Common      *common.Config
 	SshfsPath   string
 	FusrmntPath string
+	// detected along with FusrmntPath if not set
+	FuseVersion FuseVersion
+	// DefaultOptions if nil
+	Options *Options
 }
 
 type Client struct {
@@ -27,37 +32,71 @@ func NewClient(config *Config) (*Client, error) {
 			return nil, err
 		}
 	}
-	if config.FusrmntPath == "" {
-		config.FusrmntPath, err = exec.LookPath("fusermount")
+	if config.FusrmntPath == "" || config.FuseVersion == 0 {
+		version, fusermount, err := DetectFuse()
 		if err != nil {
 			return nil, err
 		}
+		if config.FusrmntPath == "" {
+			config.FusrmntPath = fusermount
+		}
+		if config.FuseVersion == 0 {
+			config.FuseVersion = version
+		}
+	}
+	if config.Options == nil {
+		config.Options = DefaultOptions()
 	}
 	return &Client{config}, nil
 }
 
+// Attach mounts the remote share at localMount and waits for the mount
+// to be live.Nothing is done if the share is already mounted there.
+// Transient failures are retried by Common.Retry
 func (c *Client) Attach(remoteShare, localMount string) error {
-	cmdStr := fmt.Sprintf(" -t fuse %s#%s@%s:%s %s -o port=%s,idmap=user,compression=no,allow_root,nonempty,Ciphers=arcfour,reconnect,transform_symlinks,StrictHostKeyChecking=no",
-		c.SshfsPath, c.Common.User, c.Common.Host, remoteShare, localMount, c.Common.Port)
-	if c.Common.PrvtKeyFile == "" {
-		cmdStr += ",password_stdin"
-		if err := ioutils.CmdPipe("echo", c.Common.Password, "mount", cmdStr); err != nil {
-			return err
-		}
-	} else {
-		cmd := exec.Command("mount")
-		cmdStr += ",IdentityFile=" + c.Common.PrvtKeyFile
-		cmd.Args = append(cmd.Args, strings.Fields(cmdStr)...)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("%s [%s]", out, err)
-		}
+	remote := RemoteSpec(c.Common.User, c.Common.Host, remoteShare)
+	if c.Common.DryRun != nil {
+		common.LogDryRun(c.Common.DryRun, c.Common.String(), "attach", remote, localMount)
+		return nil
 	}
-	return nil
+	return c.Common.Retry.Do(context.Background(), func(context.Context) error {
+		return AttachMount(remote, localMount, c.FusrmntPath, func(mountpoint string) error {
+			opts := c.Options.MountOption(c.FuseVersion, c.Common)
+			cmd := exec.Command("mount", "-t", "fuse", c.SshfsPath+"#"+remote, mountpoint)
+			var password string
+			if c.Common.PrvtKeyFile == "" {
+				// the password is passed by stdin to keep it out of the process list
+				var err error
+				if password, err = c.Common.ResolvePassword(); err != nil {
+					return err
+				}
+				opts += ",password_stdin"
+				cmd.Stdin = strings.NewReader(password + "\n")
+			}
+			cmd.Args = append(cmd.Args, "-o", opts)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return common.RedactError(fmt.Errorf("%s [%s]", out, err), append(c.Common.Secrets(), password)...)
+			}
+			return nil
+		})
+	})
 }
 
+// Detach unmounts the share.Nothing is done if it is not mounted
 func (c *Client) Detach(localMount string) error {
-	if out, err := exec.Command(c.FusrmntPath, "-u", localMount).CombinedOutput(); err != nil {
-		return fmt.Errorf("%s [%s]", out, err)
+	return c.DetachWith(localMount, DetachNormal)
+}
+
+// DetachWith unmounts the share lazily or forcibly
+func (c *Client) DetachWith(localMount string, mode DetachMode) error {
+	if c.Common.DryRun != nil {
+		common.LogDryRun(c.Common.DryRun, c.Common.String(), "detach", localMount)
+		return nil
 	}
-	return nil
+	return DetachMount(localMount, c.FusrmntPath, mode)
+}
+
+// FS returns the share mounted at localMount by Attach
+func (c *Client) FS(localMount string) remotefs.FS {
+	return remotefs.Dir(localMount)
 }
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/utils/shellutils"
+)
+
+// EscalationMethod defines how commands gain privileges
+type EscalationMethod int
+
+const (
+	EscalateNone EscalationMethod = iota
+	EscalateSudo
+	EscalateSu
+	EscalateDoas
+)
+
+var (
+	ErrEscalationPassword = errors.New("privilege escalation: incorrect password")
+	ErrEscalationRequired = errors.New("privilege escalation: password is required")
+)
+
+// prompt passed to sudo so that it can be recognized and removed from stderr
+const sudoPrompt = "[infra-sudo-password]"
+
+// Escalation is a privilege escalation policy
+type Escalation struct {
+	Method EscalationMethod
+	// target user (root if empty)
+	User string
+	// password fed to "sudo -S" over stdin.
+	// sudo is told to ignore cached credentials (-k), so the password is
+	// always read and never reaches the command.
+	// su and doas read passwords from a terminal only, so they
+	// are expected to be configured not to ask for it
+	Password string
+}
+
+// NoEscalation runs commands as is
+var NoEscalation = &Escalation{Method: EscalateNone}
+
+// DefaultRemoteEscalation is used by remote runners if no policy is set
+var DefaultRemoteEscalation = &Escalation{Method: EscalateSudo}
+
+// wrap returns the command line running command with the required
+// privileges and the input to be fed to it
+func (e *Escalation) wrap(command string) (string, io.Reader, error) {
+	shell := "/bin/sh -c " + shellutils.Quote(command)
+	var user string
+	if e.User != "" {
+		user = "-u " + shellutils.Quote(e.User) + " "
+	}
+	switch e.Method {
+	case EscalateNone:
+		return command, nil, nil
+	case EscalateSudo:
+		if e.Password == "" {
+			return "sudo -n " + user + "-- " + shell, nil, nil
+		}
+		return "sudo -k -S -p " + shellutils.Quote(sudoPrompt) + " " + user + "-- " + shell,
+			strings.NewReader(e.Password + "\n"), nil
+	case EscalateSu:
+		if e.Password != "" {
+			return "", nil, errors.New("su cannot read password from stdin")
+		}
+		target := e.User
+		if target == "" {
+			target = "root"
+		}
+		return "su " + shellutils.Quote(target) + " -c " + shellutils.Quote(command), nil, nil
+	case EscalateDoas:
+		if e.Password != "" {
+			return "", nil, errors.New("doas cannot read password from stdin")
+		}
+		return "doas -n " + user + "-- " + shell, nil, nil
+	}
+	return "", nil, fmt.Errorf("unknown escalation method %d", e.Method)
+}
+
+// check removes sudo prompts from the result and recognizes
+// escalation failures.The returned error wraps both the escalation
+// error and the error of the command
+func (e *Escalation) check(res *sshconf.Result, err error) (*sshconf.Result, error) {
+	if res == nil || e.Method == EscalateNone {
+		return res, err
+	}
+	prompts := strings.Count(res.Stderr, sudoPrompt)
+	res.Stderr = strings.Replace(res.Stderr, sudoPrompt, "", -1)
+	if err == nil {
+		return res, nil
+	}
+	stderr := strings.ToLower(res.Stderr)
+	switch {
+	case prompts > 1,
+		strings.Contains(stderr, "incorrect password"),
+		strings.Contains(stderr, "authentication failure"):
+		return res, fmt.Errorf("%w [%w]", ErrEscalationPassword, err)
+	case strings.Contains(stderr, "a password is required"),
+		strings.Contains(stderr, "a terminal is required"),
+		strings.Contains(stderr, "must be run from a terminal"),
+		strings.Contains(stderr, "no tty present"):
+		return res, fmt.Errorf("%w [%w]", ErrEscalationRequired, err)
+	}
+	return res, err
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+func TestEscalationWrap(t *testing.T) {
+	for _, tt := range []struct {
+		esc   Escalation
+		cmd   string
+		stdin string
+	}{
+		{Escalation{Method: EscalateNone}, "ls -l", ""},
+		{Escalation{Method: EscalateSudo}, "sudo -n -- /bin/sh -c 'ls -l'", ""},
+		{Escalation{Method: EscalateSudo, User: "app"}, "sudo -n -u app -- /bin/sh -c 'ls -l'", ""},
+		{Escalation{Method: EscalateSudo, Password: "secret"},
+			"sudo -k -S -p '[infra-sudo-password]' -- /bin/sh -c 'ls -l'", "secret\n"},
+		{Escalation{Method: EscalateSudo, User: "app", Password: "secret"},
+			"sudo -k -S -p '[infra-sudo-password]' -u app -- /bin/sh -c 'ls -l'", "secret\n"},
+		{Escalation{Method: EscalateSu}, "su root -c 'ls -l'", ""},
+		{Escalation{Method: EscalateSu, User: "app"}, "su app -c 'ls -l'", ""},
+		{Escalation{Method: EscalateDoas}, "doas -n -- /bin/sh -c 'ls -l'", ""},
+		{Escalation{Method: EscalateDoas, User: "app"}, "doas -n -u app -- /bin/sh -c 'ls -l'", ""},
+	} {
+		cmd, stdin, err := tt.esc.wrap("ls -l")
+		if err != nil {
+			t.Errorf("%+v: %s", tt.esc, err)
+			continue
+		}
+		if cmd != tt.cmd {
+			t.Errorf("%+v: got %q, want %q", tt.esc, cmd, tt.cmd)
+		}
+		var input string
+		if stdin != nil {
+			buf, _ := ioutil.ReadAll(stdin)
+			input = string(buf)
+		}
+		if input != tt.stdin {
+			t.Errorf("%+v: got stdin %q, want %q", tt.esc, input, tt.stdin)
+		}
+	}
+
+	for _, esc := range []Escalation{
+		{Method: EscalateSu, Password: "secret"},
+		{Method: EscalateDoas, Password: "secret"},
+		{Method: EscalationMethod(100)},
+	} {
+		if _, _, err := esc.wrap("ls"); err == nil {
+			t.Errorf("%+v: expected error", esc)
+		}
+	}
+}
+
+func TestEscalationCheck(t *testing.T) {
+	esc := &Escalation{Method: EscalateSudo, Password: "secret"}
+	for stderr, want := range map[string]error{
+		"[infra-sudo-password]": nil,
+		"[infra-sudo-password]\nSorry, try again.\n[infra-sudo-password]": ErrEscalationPassword,
+		"su: Authentication failure":                                      ErrEscalationPassword,
+		"sudo: 1 incorrect password attempt":                              ErrEscalationPassword,
+		"sudo: a password is required":                                    ErrEscalationRequired,
+		"sudo: a terminal is required to read the password":               ErrEscalationRequired,
+		"su: must be run from a terminal":                                 ErrEscalationRequired,
+		"sudo: no tty present and no askpass program":                     ErrEscalationRequired,
+		"ls: cannot access 'x': No such file or directory":                nil,
+	} {
+		res := &sshconf.Result{Command: "ls x", Stderr: stderr, ExitStatus: 1}
+		got, err := esc.check(res, &sshconf.ExitError{Result: res})
+		if got != res {
+			t.Fatalf("%q: result is not returned", stderr)
+		}
+		var kind error
+		switch {
+		case errors.Is(err, ErrEscalationPassword):
+			kind = ErrEscalationPassword
+		case errors.Is(err, ErrEscalationRequired):
+			kind = ErrEscalationRequired
+		}
+		if kind != want {
+			t.Errorf("%q: got %v, want %v", stderr, err, want)
+		}
+		var exitErr *sshconf.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Result != res {
+			t.Errorf("%q: exit error is not wrapped: %v", stderr, err)
+		}
+		if strings.Contains(res.Stderr, sudoPrompt) {
+			t.Errorf("%q: sudo prompt is not removed: %q", stderr, res.Stderr)
+		}
+	}
+
+	res := &sshconf.Result{Stderr: "[infra-sudo-password]"}
+	if _, err := esc.check(res, nil); err != nil || res.Stderr != "" {
+		t.Errorf("successful command: %v %q", err, res.Stderr)
+	}
+	res = &sshconf.Result{Stderr: "sudo: a password is required"}
+	if _, err := NoEscalation.check(res, errors.New("failed")); errors.Is(err, ErrEscalationRequired) {
+		t.Error("failure of unescalated command is classified")
+	}
+}
@@ -0,0 +1,440 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh"
+	"github.com/dorzheh/infra/utils/shellutils"
+)
+
+// Executor runs commands and accesses files on the local or a remote host
+type Executor interface {
+	// Run returns the result of the command run by the shell.
+	// A command exited with non-zero status yields *sshconf.ExitError
+	Run(ctx context.Context, command string) (*sshconf.Result, error)
+	// RunStream is like Run but feeds the command from stdin and copies
+	// its output to stdout and stderr as it arrives.
+	// Stdout and Stderr of the returned result are empty
+	RunStream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error)
+	// Upload copies the local file or directory src to dst on the host.
+	// dst is written with the escalation of the commands
+	Upload(ctx context.Context, src, dst string) error
+	// Download copies the file or directory src on the host to the local dst.
+	// src is read with the escalation of the commands
+	Download(ctx context.Context, src, dst string) error
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+	// WriteFile behaves as os.WriteFile: an existing file is truncated,
+	// a new one is created with perm.
+	// The file is written with the escalation of the commands
+	WriteFile(ctx context.Context, path string, data []byte, perm os.FileMode) error
+	Stat(ctx context.Context, path string) (os.FileInfo, error)
+	// Env returns a copy of the executor running the commands with
+	// the environment variables ("KEY=value") added
+	Env(vars ...string) Executor
+	// Dir returns a copy of the executor running the commands in dir.
+	// Relative paths of the file operations are resolved against dir as well
+	Dir(dir string) Executor
+}
+
+// NewExecutor returns LocalExecutor if config is nil
+// and SSHExecutor otherwise
+func NewExecutor(config *sshconf.Config) Executor {
+	if config == nil {
+		return &LocalExecutor{}
+	}
+	return &SSHExecutor{Config: config}
+}
+
+// Executor returns the executor running the commands of the runner
+func (r *Runner) Executor() Executor {
+	if r.Config == nil {
+		return &LocalExecutor{Escalation: r.Escalation, DryRun: r.DryRun, Transcript: r.Transcript}
+	}
+	return &SSHExecutor{Config: r.config(), Pool: r.Pool, Escalation: r.Escalation}
+}
+
+var envNameExpr = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// shellEnv holds the environment and the working directory of the commands
+type shellEnv struct {
+	env []string
+	dir string
+}
+
+func (s shellEnv) withEnv(vars []string) shellEnv {
+	s.env = append(append([]string(nil), s.env...), vars...)
+	return s
+}
+
+func (s shellEnv) withDir(dir string) shellEnv {
+	s.dir = s.path(dir)
+	return s
+}
+
+// command prefixes the command with the environment and the directory
+func (s shellEnv) command(command string) (string, error) {
+	var b strings.Builder
+	for _, kv := range s.env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !envNameExpr.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		b.WriteString("export " + name + "=" + shellutils.Quote(value) + "; ")
+	}
+	if s.dir != "" {
+		b.WriteString("cd " + shellutils.Quote(s.dir) + " || exit 1; ")
+	}
+	b.WriteString(command)
+	return b.String(), nil
+}
+
+// path resolves p against the directory
+func (s shellEnv) path(p string) string {
+	if s.dir == "" || path.IsAbs(p) {
+		return p
+	}
+	return path.Join(s.dir, p)
+}
+
+// escalated runs the command with the privileges required by esc
+func escalated(ctx context.Context, esc *Escalation, command string, stdin io.Reader, stdout, stderr io.Writer,
+	run runFunc) (*sshconf.Result, error) {
+	wrapped, escStdin, err := esc.wrap(command)
+	if err != nil {
+		return nil, err
+	}
+	if escStdin != nil {
+		if stdin != nil {
+			stdin = io.MultiReader(escStdin, stdin)
+		} else {
+			stdin = escStdin
+		}
+	}
+	return run(ctx, wrapped, stdin, stdout, stderr)
+}
+
+// buffered runs the command collecting its output into the result
+func buffered(ctx context.Context, esc *Escalation, command string, stdin io.Reader,
+	run runFunc) (*sshconf.Result, error) {
+	var stdout, stderr bytes.Buffer
+	res, err := escalated(ctx, esc, command, stdin, &stdout, &stderr, run)
+	if res != nil {
+		res.Stdout = stdout.String()
+		res.Stderr = stderr.String()
+	}
+	return esc.check(res, err)
+}
+
+// writeEscalated writes data to p by the escalated command behaving
+// as os.WriteFile.The existing file keeps its owner and mode
+func writeEscalated(ctx context.Context, esc *Escalation, p string, data []byte, perm os.FileMode, run runFunc) error {
+	q := shellutils.Quote(p)
+	command := fmt.Sprintf("{ [ -e %s ] || install -m %04o /dev/null %s; } && cat > %s", q, perm.Perm(), q, q)
+	_, err := buffered(ctx, esc, command, bytes.NewReader(data), run)
+	return err
+}
+
+// LocalExecutor runs the commands by bash on the local host
+type LocalExecutor struct {
+	// privilege escalation of the commands, file writes and copies
+	// (NoEscalation if nil).ReadFile and Stat are not escalated
+	Escalation *Escalation
+	// if set, commands and file changes are logged to DryRun
+	// instead of being done
+	DryRun io.Writer
+	// records the commands and file changes or answers them if replayed
+	Transcript *sshconf.Transcript
+	shell      shellEnv
+}
+
+func (l *LocalExecutor) escalation() *Escalation {
+	if l.Escalation == nil {
+		return NoEscalation
+	}
+	return l.Escalation
+}
+
+func (l *LocalExecutor) Run(ctx context.Context, command string) (*sshconf.Result, error) {
+	command, err := l.shell.command(command)
+	if err != nil {
+		return nil, err
+	}
+	return buffered(ctx, l.escalation(), command, nil, withModes(l.DryRun, l.Transcript, runLocal))
+}
+
+func (l *LocalExecutor) RunStream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+	command, err := l.shell.command(command)
+	if err != nil {
+		return nil, err
+	}
+	esc := l.escalation()
+	return esc.check(escalated(ctx, esc, command, stdin, stdout, stderr, withModes(l.DryRun, l.Transcript, runLocal)))
+}
+
+// Upload copies src to dst by cp (with the escalation of the commands).
+// Relative src is resolved against the working directory of the process,
+// relative dst against Dir
+func (l *LocalExecutor) Upload(ctx context.Context, src, dst string) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	_, err = l.Run(ctx, "cp -R -p -- "+shellutils.Join(src, dst))
+	return err
+}
+
+// Download is like Upload but relative src is resolved against Dir and
+// relative dst against the working directory of the process
+func (l *LocalExecutor) Download(ctx context.Context, src, dst string) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	_, err = l.Run(ctx, "cp -R -p -- "+shellutils.Join(src, dst))
+	return err
+}
+
+func (l *LocalExecutor) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	return ioutil.ReadFile(l.shell.path(p))
+}
+
+func (l *LocalExecutor) WriteFile(ctx context.Context, p string, data []byte, perm os.FileMode) error {
+	p = l.shell.path(p)
+	if esc := l.escalation(); esc.Method != EscalateNone {
+		return writeEscalated(ctx, esc, p, data, perm, withModes(l.DryRun, l.Transcript, runLocal))
+	}
+	return mutateLocal(l.DryRun, l.Transcript, "write", []string{fmt.Sprintf("%04o", perm.Perm()), p}, func() error {
+		return ioutil.WriteFile(p, data, perm)
+	})
+}
+
+func (l *LocalExecutor) Stat(ctx context.Context, p string) (os.FileInfo, error) {
+	return os.Stat(l.shell.path(p))
+}
+
+func (l *LocalExecutor) Env(vars ...string) Executor {
+	cp := *l
+	cp.shell = l.shell.withEnv(vars)
+	return &cp
+}
+
+func (l *LocalExecutor) Dir(dir string) Executor {
+	cp := *l
+	cp.shell = l.shell.withDir(dir)
+	return &cp
+}
+
+func (l *LocalExecutor) String() string {
+	return LocalHost
+}
+
+// SSHExecutor runs the commands on the remote host.
+// A new connection is dialed for every operation unless Pool is set.
+// Config.DryRun and Config.Transcript select dry-run, recording and replay modes.
+// Dry-run commands and escalated writes do not connect to the host,
+// the other file operations do since reads are done for real
+type SSHExecutor struct {
+	Config *sshconf.Config
+	Pool   *ssh.Pool
+	// privilege escalation of the commands, file writes and copies
+	// (DefaultRemoteEscalation if nil).
+	// ReadFile, Stat and unescalated writes are done over SFTP by Config.User
+	Escalation *Escalation
+	shell      shellEnv
+}
+
+func (s *SSHExecutor) escalation() *Escalation {
+	if s.Escalation == nil {
+		return DefaultRemoteEscalation
+	}
+	return s.Escalation
+}
+
+// withConn calls fn with connection to the host.
+// Unless pooled, the connection is closed once ctx is done
+// aborting the file operations in progress
+func (s *SSHExecutor) withConn(ctx context.Context, fn func(c *ssh.SshConn) error) error {
+	if s.Pool != nil {
+		c, err := s.Pool.GetContext(ctx, s.Config)
+		if err != nil {
+			return err
+		}
+		return fn(c)
+	}
+	c, err := ssh.NewSshConnContext(ctx, s.Config)
+	if err != nil {
+		return err
+	}
+	defer c.ConnClose()
+	stop := context.AfterFunc(ctx, c.ConnClose)
+	defer stop()
+	if err := fn(c); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w [%w]", ctx.Err(), err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SSHExecutor) stream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+	if s.Config.DryRun != nil {
+		sshconf.LogDryRun(s.Config.DryRun, s.Config.String(), "run", command)
+		return &sshconf.Result{Command: command}, nil
+	}
+	if s.Pool != nil {
+		return s.Pool.Stream(ctx, s.Config, command, stdin, stdout, stderr)
+	}
+	var res *sshconf.Result
+	err := s.withConn(ctx, func(c *ssh.SshConn) error {
+		var err error
+		res, err = c.StreamContext(ctx, command, stdin, stdout, stderr)
+		return err
+	})
+	return res, err
+}
+
+func (s *SSHExecutor) Run(ctx context.Context, command string) (*sshconf.Result, error) {
+	command, err := s.shell.command(command)
+	if err != nil {
+		return nil, err
+	}
+	return buffered(ctx, s.escalation(), command, nil, s.stream)
+}
+
+func (s *SSHExecutor) RunStream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+	command, err := s.shell.command(command)
+	if err != nil {
+		return nil, err
+	}
+	esc := s.escalation()
+	return esc.check(escalated(ctx, esc, command, stdin, stdout, stderr, s.stream))
+}
+
+// Upload copies src to dst over SFTP or SCP.
+// With escalation, src is uploaded to a temporary directory of
+// Config.User first and copied to dst by the escalated cp
+func (s *SSHExecutor) Upload(ctx context.Context, src, dst string) error {
+	dst = s.shell.path(dst)
+	esc := s.escalation()
+	if esc.Method == EscalateNone {
+		return s.withConn(ctx, func(c *ssh.SshConn) error {
+			return c.UploadContext(ctx, src, dst)
+		})
+	}
+	if s.Config.DryRun != nil {
+		sshconf.LogDryRun(s.Config.DryRun, s.Config.String(), "upload", src, dst)
+		return nil
+	}
+	return s.staged(ctx, esc, func(dir, owner string) error {
+		staged := path.Join(dir, filepath.Base(src))
+		err := s.withConn(ctx, func(c *ssh.SshConn) error {
+			return c.UploadContext(ctx, src, staged)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = buffered(ctx, esc, "cp -R -p -- "+shellutils.Join(staged, dst), nil, s.stream)
+		return err
+	})
+}
+
+// Download is like Upload.With escalation, src is copied to
+// a temporary directory by the escalated cp and handed over to
+// Config.User first
+func (s *SSHExecutor) Download(ctx context.Context, src, dst string) error {
+	src = s.shell.path(src)
+	esc := s.escalation()
+	if esc.Method == EscalateNone {
+		return s.withConn(ctx, func(c *ssh.SshConn) error {
+			return c.DownloadContext(ctx, src, dst)
+		})
+	}
+	if s.Config.DryRun != nil {
+		sshconf.LogDryRun(s.Config.DryRun, s.Config.String(), "download", src, dst)
+		return nil
+	}
+	return s.staged(ctx, esc, func(dir, owner string) error {
+		staged := path.Join(dir, path.Base(src))
+		q := shellutils.Quote(staged)
+		command := fmt.Sprintf("cp -R -p -- %s %s && chown -R %s %s", shellutils.Quote(src), q, owner, q)
+		if _, err := buffered(ctx, esc, command, nil, s.stream); err != nil {
+			return err
+		}
+		return s.withConn(ctx, func(c *ssh.SshConn) error {
+			return c.DownloadContext(ctx, staged, dst)
+		})
+	})
+}
+
+// staged calls fn with a temporary directory created on the host by
+// Config.User and "uid:gid" of the user.
+// The directory is removed by the escalated rm afterwards
+func (s *SSHExecutor) staged(ctx context.Context, esc *Escalation, fn func(dir, owner string) error) error {
+	res, err := buffered(ctx, NoEscalation, `mktemp -d && echo "$(id -u):$(id -g)"`, nil, s.stream)
+	if err != nil {
+		return err
+	}
+	dir, owner, _ := strings.Cut(strings.TrimSpace(res.Stdout), "\n")
+	if !path.IsAbs(dir) || owner == "" {
+		return fmt.Errorf("cannot create temporary directory: %q", res.Stdout)
+	}
+	defer buffered(context.Background(), esc, "rm -rf -- "+shellutils.Quote(dir), nil, s.stream)
+	return fn(dir, owner)
+}
+
+func (s *SSHExecutor) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	var data []byte
+	err := s.withConn(ctx, func(c *ssh.SshConn) error {
+		var err error
+		data, err = c.ReadFile(s.shell.path(p))
+		return err
+	})
+	return data, err
+}
+
+func (s *SSHExecutor) WriteFile(ctx context.Context, p string, data []byte, perm os.FileMode) error {
+	p = s.shell.path(p)
+	if esc := s.escalation(); esc.Method != EscalateNone {
+		return writeEscalated(ctx, esc, p, data, perm, s.stream)
+	}
+	return s.withConn(ctx, func(c *ssh.SshConn) error {
+		return c.WriteFile(p, data, perm)
+	})
+}
+
+func (s *SSHExecutor) Stat(ctx context.Context, p string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := s.withConn(ctx, func(c *ssh.SshConn) error {
+		var err error
+		info, err = c.Stat(s.shell.path(p))
+		return err
+	})
+	return info, err
+}
+
+func (s *SSHExecutor) Env(vars ...string) Executor {
+	cp := *s
+	cp.shell = s.shell.withEnv(vars)
+	return &cp
+}
+
+func (s *SSHExecutor) Dir(dir string) Executor {
+	cp := *s
+	cp.shell = s.shell.withDir(dir)
+	return &cp
+}
+
+func (s *SSHExecutor) String() string {
+	return s.Config.String()
+}
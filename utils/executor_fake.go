@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+// Call is an operation recorded by FakeExecutor
+type Call struct {
+	// "run", "stream", "upload", "download", "read", "write" or "stat"
+	Op string
+	// the command or the paths
+	Args []string
+	// environment and directory of the executor
+	Env []string
+	Dir string
+}
+
+// FakeExecutor records the operations instead of doing them.
+// Commands are answered by the handler, files live in memory.
+// Suits the tests of the code accepting Executor
+type FakeExecutor struct {
+	rec   *fakeRecorder
+	shell shellEnv
+}
+
+type fakeRecorder struct {
+	sync.Mutex
+	handler func(command string) (*sshconf.Result, error)
+	calls   []Call
+	files   map[string]*fakeFile
+}
+
+type fakeFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewFakeExecutor returns FakeExecutor answering the commands by handler.
+// If handler is nil or returns nil result, the commands succeed with no output
+func NewFakeExecutor(handler func(command string) (*sshconf.Result, error)) *FakeExecutor {
+	return &FakeExecutor{rec: &fakeRecorder{handler: handler, files: make(map[string]*fakeFile)}}
+}
+
+func (f *FakeExecutor) record(op string, args ...string) {
+	f.rec.calls = append(f.rec.calls, Call{
+		Op:   op,
+		Args: args,
+		Env:  append([]string(nil), f.shell.env...),
+		Dir:  f.shell.dir,
+	})
+}
+
+// Calls returns the operations recorded so far
+func (f *FakeExecutor) Calls() []Call {
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	return append([]Call(nil), f.rec.calls...)
+}
+
+// Commands returns the commands run so far
+func (f *FakeExecutor) Commands() []string {
+	var commands []string
+	for _, c := range f.Calls() {
+		if c.Op == "run" || c.Op == "stream" {
+			commands = append(commands, c.Args[0])
+		}
+	}
+	return commands
+}
+
+// Files returns paths of the files in memory sorted
+func (f *FakeExecutor) Files() []string {
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	var paths []string
+	for p := range f.rec.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (f *FakeExecutor) run(ctx context.Context, op, command string) (*sshconf.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.rec.Lock()
+	f.record(op, command)
+	handler := f.rec.handler
+	f.rec.Unlock()
+	var res *sshconf.Result
+	var err error
+	if handler != nil {
+		res, err = handler(command)
+	}
+	if res == nil {
+		if err != nil {
+			return nil, err
+		}
+		res = &sshconf.Result{}
+	}
+	// the handler may return a shared result
+	cp := *res
+	res = &cp
+	res.Command = command
+	if err == nil && (res.ExitStatus != 0 || res.Signal != "") {
+		err = &sshconf.ExitError{Result: res}
+	}
+	return res, err
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, command string) (*sshconf.Result, error) {
+	return f.run(ctx, "run", command)
+}
+
+// RunStream writes stdout and stderr of the handler result to stdout
+// and stderr.stdin is not read
+func (f *FakeExecutor) RunStream(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+	res, err := f.run(ctx, "stream", command)
+	if res == nil {
+		return nil, err
+	}
+	if stdout != nil {
+		io.WriteString(stdout, res.Stdout)
+	}
+	if stderr != nil {
+		io.WriteString(stderr, res.Stderr)
+	}
+	streamed := *res
+	streamed.Stdout, streamed.Stderr = "", ""
+	if err != nil {
+		if _, ok := err.(*sshconf.ExitError); ok {
+			err = &sshconf.ExitError{Result: &streamed}
+		}
+	}
+	return &streamed, err
+}
+
+// Upload is recorded only, no file is created
+func (f *FakeExecutor) Upload(ctx context.Context, src, dst string) error {
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	f.record("upload", src, f.shell.path(dst))
+	return ctx.Err()
+}
+
+// Download is recorded only, no file is created
+func (f *FakeExecutor) Download(ctx context.Context, src, dst string) error {
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	f.record("download", f.shell.path(src), dst)
+	return ctx.Err()
+}
+
+func (f *FakeExecutor) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	p = f.shell.path(p)
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	f.record("read", p)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, ok := f.rec.files[p]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), file.data...), nil
+}
+
+func (f *FakeExecutor) WriteFile(ctx context.Context, p string, data []byte, perm os.FileMode) error {
+	p = f.shell.path(p)
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	f.record("write", p)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// an existing file keeps its mode as with os.WriteFile
+	if file, ok := f.rec.files[p]; ok {
+		perm = file.mode
+	}
+	f.rec.files[p] = &fakeFile{data: append([]byte(nil), data...), mode: perm, modTime: time.Now()}
+	return nil
+}
+
+func (f *FakeExecutor) Stat(ctx context.Context, p string) (os.FileInfo, error) {
+	p = f.shell.path(p)
+	f.rec.Lock()
+	defer f.rec.Unlock()
+	f.record("stat", p)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, ok := f.rec.files[p]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return &fakeFileInfo{name: path.Base(p), file: *file}, nil
+}
+
+// Env returns a copy sharing the recorded operations and the files
+func (f *FakeExecutor) Env(vars ...string) Executor {
+	return &FakeExecutor{rec: f.rec, shell: f.shell.withEnv(vars)}
+}
+
+// Dir returns a copy sharing the recorded operations and the files
+func (f *FakeExecutor) Dir(dir string) Executor {
+	return &FakeExecutor{rec: f.rec, shell: f.shell.withDir(dir)}
+}
+
+func (f *FakeExecutor) String() string {
+	return "fake"
+}
+
+type fakeFileInfo struct {
+	name string
+	file fakeFile
+}
+
+func (i *fakeFileInfo) Name() string       { return i.name }
+func (i *fakeFileInfo) Size() int64        { return int64(len(i.file.data)) }
+func (i *fakeFileInfo) Mode() os.FileMode  { return i.file.mode }
+func (i *fakeFileInfo) ModTime() time.Time { return i.file.modTime }
+func (i *fakeFileInfo) IsDir() bool        { return false }
+func (i *fakeFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,283 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh/sshtest"
+)
+
+func TestLocalExecutorEnvDir(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "it's a dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := (&LocalExecutor{}).Env(`FOO=a 'b' "c" $d`, "BAR=").Dir(dir)
+	res, err := e.Run(ctx, `printf '%s|%s|' "$FOO" "$BAR"; pwd`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `a 'b' "c" $d||` + dir + "\n"; res.Stdout != want {
+		t.Errorf("got %q, want %q", res.Stdout, want)
+	}
+	if _, err := e.Env("1FOO=x").Run(ctx, "true"); err == nil {
+		t.Error("invalid variable name is accepted")
+	}
+
+	// relative paths of the file operations are resolved against Dir
+	if err := e.WriteFile(ctx, "file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(buf) != "data" {
+		t.Fatalf("got %q %v", buf, err)
+	}
+	if buf, err := e.ReadFile(ctx, "file"); err != nil || string(buf) != "data" {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if fi, err := e.Stat(ctx, "file"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got %v %v", fi, err)
+	}
+}
+
+func TestLocalExecutorCopy(t *testing.T) {
+	ctx := context.Background()
+	cwd, dir := t.TempDir(), t.TempDir()
+	t.Chdir(cwd)
+	if err := ioutil.WriteFile("src", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := (&LocalExecutor{}).Dir(dir)
+
+	// relative local paths are resolved against the working directory
+	// of the process, relative paths of the host against Dir
+	if err := e.Upload(ctx, "src", "uploaded"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "uploaded")); err != nil || string(buf) != "data" {
+		t.Fatalf("upload: got %q %v", buf, err)
+	}
+	if err := e.Download(ctx, "uploaded", "downloaded"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(cwd, "downloaded")); err != nil || string(buf) != "data" {
+		t.Errorf("download: got %q %v", buf, err)
+	}
+}
+
+func TestExecutorEscalation(t *testing.T) {
+	ctx := context.Background()
+	var log bytes.Buffer
+	e := (&LocalExecutor{
+		Escalation: &Escalation{Method: EscalateSudo, User: "app"},
+		DryRun:     &log,
+	}).Dir("/srv")
+
+	if _, err := e.Run(ctx, "ls -l"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteFile(ctx, "app.conf", []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q", log.String())
+	}
+	if want := "[dry-run] " + LocalHost + ": run sudo -n -u app -- /bin/sh -c 'cd /srv || exit 1; ls -l'"; lines[0] != want {
+		t.Errorf("got %q, want %q", lines[0], want)
+	}
+	for _, want := range []string{
+		"run sudo -n -u app -- /bin/sh -c ",
+		"install -m 0640 /dev/null ",
+		"cat > ",
+		"/srv/app.conf",
+	} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("%q: %q is missing", lines[1], want)
+		}
+	}
+	if _, err := os.Stat("/srv/app.conf"); err == nil {
+		t.Error("file is written in dry-run")
+	}
+}
+
+func TestSSHExecutorFiles(t *testing.T) {
+	ctx := context.Background()
+	server := sshtest.NewServer(t, nil)
+	dir := t.TempDir()
+
+	// unescalated writes are done over SFTP
+	e := (&SSHExecutor{Config: server.Config(), Escalation: NoEscalation}).Dir(dir)
+	if err := e.WriteFile(ctx, "file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := e.ReadFile(ctx, "file"); err != nil || string(buf) != "data" {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if fi, err := e.Stat(ctx, "file"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got %v %v", fi, err)
+	}
+
+	// escalated writes are done by the escalated command
+	var log bytes.Buffer
+	config := server.Config()
+	config.DryRun = &log
+	e = (&SSHExecutor{Config: config}).Dir(dir)
+	if err := e.WriteFile(ctx, "file", []byte("new data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "sudo -n -- /bin/sh -c ") || !strings.Contains(log.String(), "cat > ") {
+		t.Errorf("got %q", log.String())
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "file")); string(buf) != "data" {
+		t.Errorf("file is written in dry-run: %q", buf)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := e.ReadFile(cancelled, "file"); err == nil {
+		t.Error("cancelled read succeeded")
+	}
+}
+
+func TestSSHExecutorEscalatedCopy(t *testing.T) {
+	if _, err := exec.LookPath("su"); err != nil || os.Getuid() != 0 {
+		t.Skip("su of root to itself is not available")
+	}
+	ctx := context.Background()
+	server := sshtest.NewServer(t, nil)
+	local, remote := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(local, "src"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := (&SSHExecutor{Config: server.Config(), Escalation: &Escalation{Method: EscalateSu}}).Dir(remote)
+	if err := e.Upload(ctx, filepath.Join(local, "src"), "uploaded"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(remote, "uploaded")); err != nil || string(buf) != "data" {
+		t.Fatalf("upload: got %q %v", buf, err)
+	}
+	if err := e.Download(ctx, "uploaded", filepath.Join(local, "downloaded")); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(local, "downloaded")); err != nil || string(buf) != "data" {
+		t.Errorf("download: got %q %v", buf, err)
+	}
+}
+
+func TestWriteEscalated(t *testing.T) {
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "it's a file")
+
+	// a new file is created with perm
+	if err := writeEscalated(ctx, NoEscalation, p, []byte("long data"), 0600, runLocal); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("got %v %v", fi, err)
+	}
+
+	// an existing file is truncated and keeps its mode
+	if err := os.Chmod(p, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEscalated(ctx, NoEscalation, p, []byte("data"), 0600, runLocal); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(p); err != nil || string(buf) != "data" {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("got %v %v", fi, err)
+	}
+}
+
+func TestFakeExecutor(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeExecutor(func(command string) (*sshconf.Result, error) {
+		if command == "false" {
+			return &sshconf.Result{ExitStatus: 1}, nil
+		}
+		return &sshconf.Result{Stdout: "out"}, nil
+	})
+	e := f.Env("FOO=bar").Dir("/srv")
+
+	if res, err := e.Run(ctx, "true"); err != nil || res.Stdout != "out" {
+		t.Errorf("got %+v %v", res, err)
+	}
+	if _, err := f.Run(ctx, "false"); err == nil {
+		t.Error("non-zero exit status is not reported")
+	} else if _, ok := err.(*sshconf.ExitError); !ok {
+		t.Errorf("got %T", err)
+	}
+	if err := e.WriteFile(ctx, "app.conf", []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := f.ReadFile(ctx, "/srv/app.conf"); err != nil || string(buf) != "data" {
+		t.Errorf("got %q %v", buf, err)
+	}
+	if _, err := f.Stat(ctx, "app.conf"); !os.IsNotExist(err) {
+		t.Errorf("got %v", err)
+	}
+
+	want := []Call{
+		{Op: "run", Args: []string{"true"}, Env: []string{"FOO=bar"}, Dir: "/srv"},
+		{Op: "run", Args: []string{"false"}},
+		{Op: "write", Args: []string{"/srv/app.conf"}, Env: []string{"FOO=bar"}, Dir: "/srv"},
+		{Op: "read", Args: []string{"/srv/app.conf"}},
+		{Op: "stat", Args: []string{"app.conf"}},
+	}
+	if got := f.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := f.Commands(); !reflect.DeepEqual(got, []string{"true", "false"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := f.Files(); !reflect.DeepEqual(got, []string{"/srv/app.conf"}) {
+		t.Errorf("got %q", got)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := f.ReadFile(cancelled, "/srv/app.conf"); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+
+	// an existing file keeps its mode
+	if err := f.WriteFile(ctx, "/srv/app.conf", []byte("new data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := f.Stat(ctx, "/srv/app.conf"); err != nil || fi.Mode() != 0640 || fi.Size() != 8 {
+		t.Errorf("got %v %v", fi, err)
+	}
+}
+
+func TestFakeExecutorSharedResult(t *testing.T) {
+	shared := &sshconf.Result{Stdout: "out"}
+	f := NewFakeExecutor(func(string) (*sshconf.Result, error) {
+		return shared, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(context.Background(), "one")
+	}()
+	res, err := f.Run(context.Background(), "two")
+	<-done
+	if err != nil || res.Command != "two" || res == shared {
+		t.Errorf("got %+v %v", res, err)
+	}
+	if shared.Command != "" {
+		t.Errorf("handler result is changed: %+v", shared)
+	}
+}
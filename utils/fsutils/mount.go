@@ -44,13 +44,40 @@ func parseInfoFile(r io.Reader) ([]*procEntry, error) {
 			&p.source, &p.mountpoint, &p.fs, &p.opts); err != nil {
 			return nil, fmt.Errorf("Scanning '%s' failed: %s", text, err)
 		}
+		p.source, p.mountpoint = unescapeOctal(p.source), unescapeOctal(p.mountpoint)
 		out = append(out, p)
 	}
 	return out, nil
 }
 
+// unescapeOctal decodes white space escaped in /proc/mounts ("\040")
+func unescapeOctal(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1:i+4]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '7' {
+			return false
+		}
+	}
+	return true
+}
+
 // Looks at /proc/mounts to determine of the specified
-// mountpoint has been mounted
+// mountpoint has been mounted.The device is not looked up if empty
 func Mounted(device, mountpoint string) (bool, error) {
 	entries, err := parseMountTable()
 	if err != nil {
@@ -58,9 +85,25 @@ func Mounted(device, mountpoint string) (bool, error) {
 	}
 	// Search the table for the mountpoint
 	for _, entry := range entries {
-		if entry.mountpoint == mountpoint || strings.Contains(entry.source, device) {
+		if entry.mountpoint == mountpoint || device != "" && strings.Contains(entry.source, device) {
 			return true, nil
 		}
 	}
 	return false, nil
 }
+
+// MountSource returns source of the file system mounted at mountpoint
+// (the last one if stacked).Returns false if nothing is mounted there
+func MountSource(mountpoint string) (string, bool, error) {
+	entries, err := parseMountTable()
+	if err != nil {
+		return "", false, err
+	}
+	source, found := "", false
+	for _, entry := range entries {
+		if entry.mountpoint == mountpoint {
+			source, found = entry.source, true
+		}
+	}
+	return source, found, nil
+}
@@ -2,12 +2,14 @@ package utils
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	sshconf "github.com/dorzheh/infra/comm/common"
 	"github.com/dorzheh/infra/comm/ssh"
@@ -25,41 +27,211 @@ func ConnFunc(config *sshconf.Config) func() (*ssh.SshConn, error) {
 	}
 }
 
-// RunFunc is a generic solution for running appropriate commands
-// on local or remote host
-func RunFunc(config *sshconf.Config) func(string) (string, error) {
-	if config == nil {
-		return func(command string) (string, error) {
-			var stderr bytes.Buffer
-			var stdout bytes.Buffer
-			c := exec.Command("/bin/bash", "-c", command)
-			c.Stderr = &stderr
-			c.Stdout = &stdout
-			if err := c.Start(); err != nil {
-				return "", err
-			}
-			if err := c.Wait(); err != nil {
-				return "", fmt.Errorf("executing %s  : %s [%s]", command, stderr.String(), err)
-			}
-			return strings.TrimSpace(stdout.String()), nil
+// PooledConnFunc is like ConnFunc but takes the connection from the pool.
+// The connection is owned by the pool and must not be closed
+func PooledConnFunc(pool *ssh.Pool, config *sshconf.Config) func() (*ssh.SshConn, error) {
+	return func() (*ssh.SshConn, error) {
+		return pool.Get(config)
+	}
+}
+
+// Runner runs commands on the local host (Config is nil)
+// or on the remote one
+type Runner struct {
+	Config *sshconf.Config
+	// if set, remote commands share pooled connections
+	// instead of dialing a new one for every command
+	Pool *ssh.Pool
+	// privilege escalation policy.If nil, remote commands are run
+	// by sudo (DefaultRemoteEscalation) and local ones as is
+	Escalation *Escalation
+	// if set, the commands are logged to DryRun instead of being run
+	// and the host is not connected.
+	// Overrides Config.DryRun
+	DryRun io.Writer
+	// records the commands run or answers them if replayed.
+	// Overrides Config.Transcript
+	Transcript *sshconf.Transcript
+	// retries connecting to the remote host.
+	// Overrides Config.Retry
+	Retry *sshconf.RetryPolicy
+}
+
+// config returns Config with the settings of the runner applied
+func (r *Runner) config() *sshconf.Config {
+	if r.Config == nil || (r.DryRun == nil && r.Transcript == nil && r.Retry == nil) {
+		return r.Config
+	}
+	c := *r.Config
+	if r.DryRun != nil {
+		c.DryRun = r.DryRun
+	}
+	if r.Transcript != nil {
+		c.Transcript = r.Transcript
+	}
+	if r.Retry != nil {
+		c.Retry = r.Retry
+	}
+	return &c
+}
+
+// Run returns output of the command
+func (r *Runner) Run(command string) (string, error) {
+	res, err := r.Exec(command)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(res.Stdout), nil
+}
+
+// Exec returns the whole result of the command.
+// A command exited with non-zero status yields *sshconf.ExitError
+func (r *Runner) Exec(command string) (*sshconf.Result, error) {
+	esc := r.Escalation
+	if esc == nil {
+		esc = NoEscalation
+		if r.Config != nil {
+			esc = DefaultRemoteEscalation
 		}
 	}
-	return func(command string) (string, error) {
-		c, err := ssh.NewSshConn(config)
-		if err != nil {
-			return "", err
+	wrapped, stdin, err := esc.wrap(command)
+	if err != nil {
+		return nil, err
+	}
+	return esc.check(r.exec(wrapped, stdin))
+}
+
+func (r *Runner) exec(command string, stdin io.Reader) (*sshconf.Result, error) {
+	if r.Config == nil {
+		return execLocal(withModes(r.DryRun, r.Transcript, runLocal), command, stdin)
+	}
+	config := r.config()
+	if config.DryRun != nil {
+		// nothing to connect for
+		sshconf.LogDryRun(config.DryRun, config.String(), "run", command)
+		return &sshconf.Result{Command: command}, nil
+	}
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	var res *sshconf.Result
+	var err error
+	if r.Pool != nil {
+		res, err = r.Pool.Stream(context.Background(), config, command, stdin, &stdout, &stderr)
+	} else {
+		var c *ssh.SshConn
+		if c, err = ssh.NewSshConn(config); err != nil {
+			return nil, err
 		}
 		defer c.ConnClose()
-		outstr, errstr, err := c.Run("sudo " + command)
-		if err != nil {
-			return "", fmt.Errorf("executing %s : %s [%s]", command, errstr, err)
+		res, err = c.Stream(command, stdin, &stdout, &stderr)
+	}
+	if res != nil {
+		res.Stdout = stdout.String()
+		res.Stderr = stderr.String()
+	}
+	return res, err
+}
+
+// RunFunc is a generic solution for running appropriate commands
+// on local or remote host.
+// Config.DryRun and Config.Transcript select dry-run, recording
+// and replay modes of the remote commands, Config.Retry retries
+// connecting to the host
+func RunFunc(config *sshconf.Config) func(string) (string, error) {
+	return (&Runner{Config: config}).Run
+}
+
+// DryRunFunc is like RunFunc but the commands are logged to w
+// (os.Stderr if nil) instead of being run
+func DryRunFunc(config *sshconf.Config, w io.Writer) func(string) (string, error) {
+	if w == nil {
+		w = os.Stderr
+	}
+	return (&Runner{Config: config, DryRun: w}).Run
+}
+
+// PooledRunFunc is like RunFunc but remote commands share
+// connections from the pool
+func PooledRunFunc(pool *ssh.Pool, config *sshconf.Config) func(string) (string, error) {
+	return (&Runner{Config: config, Pool: pool}).Run
+}
+
+// ExecFunc is like RunFunc but the returned function provides
+// the whole result of the command.
+// A command exited with non-zero status yields *sshconf.ExitError
+func ExecFunc(config *sshconf.Config) func(string) (*sshconf.Result, error) {
+	return (&Runner{Config: config}).Exec
+}
+
+func execLocal(run runFunc, command string, stdin io.Reader) (*sshconf.Result, error) {
+	var stdout, stderr bytes.Buffer
+	res, err := run(context.Background(), command, stdin, &stdout, &stderr)
+	if res != nil {
+		res.Stdout = stdout.String()
+		res.Stderr = stderr.String()
+	}
+	return res, err
+}
+
+// runLocal runs the command by bash connecting it to stdin, stdout and stderr.
+// The command is killed once ctx is done
+func runLocal(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+	c := exec.CommandContext(ctx, "/bin/bash", "-c", command)
+	c.Stdin = stdin
+	c.Stderr = stderr
+	c.Stdout = stdout
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	err := c.Wait()
+	res := &sshconf.Result{
+		Command:  command,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		res.ExitStatus = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			res.ExitStatus = exitErr.ExitCode()
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				res.Signal = signalName(ws.Signal())
+			}
+			return res, &sshconf.ExitError{Result: res}
 		}
-		return strings.TrimSpace(outstr), nil
+		return res, err
+	}
+	return res, nil
+}
+
+// signals defined by RFC 4254 in the form used by SSH
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
 	}
+	return sig.String()
 }
 
 // InterruptHandler is trying to release appropriate image
-// in case SIGHUP, SIGINT or SIGTERM signal received
+// in case SIGHUP, SIGINT or SIGTERM signal received.
+//
+// Deprecated: fn is called on every signal, its error is ignored and
+// the process keeps running.Use Shutdown
 func InterruptHandler(fn func() error) {
 	//create a channel for interrupt handler
 	interrupt := make(chan os.Signal, 1)
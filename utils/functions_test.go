@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh"
+)
+
+func TestRunnerDryRun(t *testing.T) {
+	// nothing listens on the port, so connecting fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	config := &sshconf.Config{Host: host, Port: port, User: "test", Password: "test"}
+
+	pool := ssh.NewPool(0, 0)
+	defer pool.Close()
+	var log bytes.Buffer
+	for _, r := range []*Runner{
+		{Config: config, DryRun: &log},
+		{Config: config, DryRun: &log, Pool: pool},
+	} {
+		if out, err := r.Run("uname"); err != nil || out != "" {
+			t.Errorf("got %q %v", out, err)
+		}
+	}
+	e := &SSHExecutor{Config: &sshconf.Config{Host: host, Port: port, User: "test", DryRun: &log}}
+	if _, err := e.Run(context.Background(), "uname"); err != nil {
+		t.Error(err)
+	}
+	want := strings.Repeat("[dry-run] "+config.String()+": run sudo -n -- /bin/sh -c uname\n", 3)
+	if log.String() != want {
+		t.Errorf("got %q, want %q", log.String(), want)
+	}
+}
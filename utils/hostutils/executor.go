@@ -0,0 +1,75 @@
+package hostutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dorzheh/infra/utils"
+	"github.com/dorzheh/infra/utils/netutils"
+	"github.com/dorzheh/infra/utils/shellutils"
+)
+
+// SetHostnameOn is like SetHostname but configures the host of the executor
+func SetHostnameOn(ctx context.Context, e utils.Executor, hostname string) error {
+	if err := utils.ValidateHostname(hostname); err != nil {
+		return err
+	}
+	for _, leaf := range template {
+		if _, err := e.Stat(ctx, leaf["RELEASE_FILE"].(string)); err != nil {
+			continue
+		}
+		file := leaf["HOST_FILE"].(string)
+		data := []byte(hostname + "\n")
+		if file != "/etc/hostname" {
+			current, err := e.ReadFile(ctx, file)
+			if err != nil {
+				return err
+			}
+			data = regexp.MustCompile(`HOSTNAME\s*=\s*\S+`).ReplaceAll(current, []byte("HOSTNAME="+hostname))
+		}
+		if err := e.WriteFile(ctx, file, data, 0644); err != nil {
+			return err
+		}
+	}
+	_, err := e.Run(ctx, "hostname "+shellutils.Quote(hostname))
+	return err
+}
+
+// SetHostsOn is like SetHosts but configures the host of the executor
+func SetHostsOn(ctx context.Context, e utils.Executor, hostname, ipv4 string) error {
+	data, err := e.ReadFile(ctx, "/etc/hosts")
+	if err != nil {
+		return err
+	}
+	pat, err := regexp.Compile(regexp.QuoteMeta(ipv4) + `\s+` + regexp.QuoteMeta(hostname))
+	if err != nil {
+		return err
+	}
+	if pat.Match(data) {
+		return nil
+	}
+	data = append(data, fmt.Sprintf("\n%s\t%s\n", ipv4, hostname)...)
+	return e.WriteFile(ctx, "/etc/hosts", data, 0644)
+}
+
+// SetHostsDefaultOn is like SetHostsDefault but configures the host of the executor
+func SetHostsDefaultOn(ctx context.Context, e utils.Executor, defaultIface string, force bool) error {
+	res, err := e.Run(ctx, "hostname")
+	if err != nil {
+		return err
+	}
+	hname := strings.TrimSpace(res.Stdout)
+	if !force {
+		// resolvable by the host itself
+		if _, err := e.Run(ctx, "getent hosts "+shellutils.Quote(hname)); err == nil {
+			return nil
+		}
+	}
+	iface, err := netutils.GetIfaceAddrOn(ctx, e, defaultIface)
+	if err != nil {
+		return err
+	}
+	return SetHostsOn(ctx, e, hname, strings.Split(iface.String(), "/")[0])
+}
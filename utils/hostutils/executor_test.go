@@ -0,0 +1,63 @@
+package hostutils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dorzheh/infra/utils"
+)
+
+func TestSetHostsOn(t *testing.T) {
+	ctx := context.Background()
+	e := utils.NewFakeExecutor(nil)
+	e.WriteFile(ctx, "/etc/hosts", []byte("127.0.0.1\tlocalhost\n"), 0644)
+
+	for i := 0; i < 2; i++ {
+		if err := SetHostsOn(ctx, e, "node1", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := e.ReadFile(ctx, "/etc/hosts")
+	if want := "127.0.0.1\tlocalhost\n\n10.0.0.1\tnode1\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	writes := 0
+	for _, c := range e.Calls() {
+		if c.Op == "write" {
+			writes++
+		}
+	}
+	if writes != 2 {
+		t.Errorf("existing entry is written again (%d writes)", writes)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := SetHostsOn(cancelled, e, "node2", "10.0.0.2"); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSetHostnameOn(t *testing.T) {
+	ctx := context.Background()
+	e := utils.NewFakeExecutor(nil)
+	e.WriteFile(ctx, "/etc/redhat-release", nil, 0644)
+	e.WriteFile(ctx, "/etc/sysconfig/network", []byte("NETWORKING=yes\nHOSTNAME=old\n"), 0644)
+
+	if err := SetHostnameOn(ctx, e, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := e.ReadFile(ctx, "/etc/sysconfig/network")
+	if want := "NETWORKING=yes\nHOSTNAME=node1\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	if _, err := e.Stat(ctx, "/etc/hostname"); err == nil {
+		t.Error("hostname file of another distribution is written")
+	}
+	if commands := e.Commands(); len(commands) != 1 || commands[0] != "hostname node1" {
+		t.Errorf("got %q", commands)
+	}
+	if err := SetHostnameOn(ctx, e, "-invalid"); err == nil {
+		t.Error("invalid hostname is accepted")
+	}
+}
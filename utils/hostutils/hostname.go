@@ -1,12 +1,11 @@
 package hostutils
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"strings"
-	"syscall"
 
 	"github.com/dorzheh/infra/utils"
 	"github.com/dorzheh/infra/utils/ioutils"
@@ -15,34 +14,18 @@ import (
 
 var template = map[uint8]map[string]interface{}{
 	1: {
-		"RELEASE_FILE":      "/etc/lsb_release",
-		"HOST_FILE":         "/etc/hostname",
-		"SET_HOSTNAME_FUNC": setHostnameDebian,
+		"RELEASE_FILE": "/etc/lsb_release",
+		"HOST_FILE":    "/etc/hostname",
 	},
 	2: {
-		"RELEASE_FILE":      "/etc/redhat-release",
-		"HOST_FILE":         "/etc/sysconfig/network",
-		"SET_HOSTNAME_FUNC": setHostnameRhel,
+		"RELEASE_FILE": "/etc/redhat-release",
+		"HOST_FILE":    "/etc/sysconfig/network",
 	},
 }
 
 // SetHostname - main wrapper for the host configuration
 func SetHostname(hostname string) error {
-	if err := utils.ValidateHostname(hostname); err != nil {
-		return err
-	}
-	for _, leaf := range template {
-		for key, val := range leaf {
-			if key == "RELEASE_FILE" {
-				if _, err := os.Stat(val.(string)); err == nil {
-					if err := leaf["SET_HOSTNAME_FUNC"].(func(string, string) error)(hostname, leaf["HOST_FILE"].(string)); err != nil {
-						return err
-					}
-				}
-			}
-		}
-	}
-	return syscall.Sethostname([]byte(hostname))
+	return SetHostnameOn(context.Background(), &utils.LocalExecutor{}, hostname)
 }
 
 // SetHosts inyended for the hosts file configuration
@@ -74,16 +57,3 @@ func SetHostsDefault(defaultIface string, force bool) error {
 	}
 	return SetHosts(hname, strings.Split(iface.String(), "/")[0])
 }
-
-// setHostnameDebian responsible for setting hostname for a Debian
-// based distribution(Debian,Ubuntu...)
-func setHostnameDebian(hostname, file string) error {
-	return ioutil.WriteFile(file, []byte(hostname), 0)
-}
-
-// setHostnameRhel responsible for setting hostname for
-// a distro based on RHEL(RHEL,CentOS...)
-func setHostnameRhel(hostname, file string) error {
-	return ioutils.FindAndReplace(file, file, `HOSTNAME\s*=\s*\S+`,
-		fmt.Sprintf("HOSTNAME=%s", hostname), 0644)
-}
@@ -0,0 +1,89 @@
+package hostutils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/comm/ssh"
+	"github.com/dorzheh/infra/utils"
+)
+
+const bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+var errBootIDUnchanged = errors.New("boot id has not changed")
+
+// WaitForSSH polls until the SSH handshake with the host described by
+// config succeeds and returns the connection (the caller closes it).
+// Authentication and host key failures end the waiting at once.
+// Every attempt is limited by config.Timeout (the max poll interval
+// if zero).
+// Fails with utils.ErrWaitTimeout once timeout expires (no limit if zero)
+func WaitForSSH(ctx context.Context, config *sshconf.Config, timeout time.Duration) (*ssh.SshConn, error) {
+	if config.Timeout == 0 {
+		// a handshake hanging on the rebooting host must not stall the polling
+		c := *config
+		c.Timeout = utils.DefaultPollPolicy.MaxDelay
+		config = &c
+	}
+	var conn *ssh.SshConn
+	err := utils.Poll(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		conn, err = ssh.NewSshConnContext(ctx, config)
+		if err != nil && !sshconf.IsRetryable(err) {
+			return sshconf.Permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WaitForCommand polls until the command run by the executor succeeds.
+// Fails with utils.ErrWaitTimeout once timeout expires (no limit if zero)
+func WaitForCommand(ctx context.Context, e utils.Executor, command string, timeout time.Duration) error {
+	return utils.Poll(ctx, timeout, func(ctx context.Context) error {
+		_, err := e.Run(ctx, command)
+		return err
+	})
+}
+
+// BootID returns id of the current boot of the host.
+// The id changes on every boot
+func BootID(ctx context.Context, e utils.Executor) (string, error) {
+	data, err := e.ReadFile(ctx, bootIDFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// WaitForReboot polls until the host is back with boot id other than
+// bootID read by BootID before the reboot:
+//
+//	id, err := hostutils.BootID(ctx, e)
+//	...
+//	e.Run(ctx, "reboot")
+//	err = hostutils.WaitForReboot(ctx, e, id, 10*time.Minute)
+//
+// Every attempt is limited by the max poll interval.
+// Fails with utils.ErrWaitTimeout once timeout expires (no limit if zero)
+func WaitForReboot(ctx context.Context, e utils.Executor, bootID string, timeout time.Duration) error {
+	return utils.Poll(ctx, timeout, func(ctx context.Context) error {
+		// a read hanging on the rebooting host must not stall the polling
+		ctx, cancel := context.WithTimeout(ctx, utils.DefaultPollPolicy.MaxDelay)
+		defer cancel()
+		id, err := BootID(ctx, e)
+		if err != nil {
+			return err
+		}
+		if id == bootID {
+			return errBootIDUnchanged
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+package hostutils
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/utils"
+)
+
+func TestWaitForReboot(t *testing.T) {
+	ctx := context.Background()
+	e := utils.NewFakeExecutor(nil)
+	e.WriteFile(ctx, bootIDFile, []byte("old\n"), 0444)
+	id, err := BootID(ctx, e)
+	if err != nil || id != "old" {
+		t.Fatalf("got %q %v", id, err)
+	}
+
+	if err := WaitForReboot(ctx, e, id, 100*time.Millisecond); !errors.Is(err, utils.ErrWaitTimeout) {
+		t.Errorf("got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := WaitForReboot(cancelled, e, id, time.Minute); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+
+	e.WriteFile(ctx, bootIDFile, []byte("new\n"), 0444)
+	if err := WaitForReboot(ctx, e, id, time.Minute); err != nil {
+		t.Error(err)
+	}
+}
+
+// stallingExecutor hangs the first read until ctx is done
+type stallingExecutor struct {
+	utils.Executor
+	reads int32
+}
+
+func (e *stallingExecutor) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	if atomic.AddInt32(&e.reads, 1) == 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return e.Executor.ReadFile(ctx, p)
+}
+
+func TestWaitForRebootStalled(t *testing.T) {
+	defer func(p *sshconf.RetryPolicy) { utils.DefaultPollPolicy = p }(utils.DefaultPollPolicy)
+	utils.DefaultPollPolicy = &sshconf.RetryPolicy{InitialDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}
+
+	ctx := context.Background()
+	fake := utils.NewFakeExecutor(nil)
+	fake.WriteFile(ctx, bootIDFile, []byte("new\n"), 0444)
+	e := &stallingExecutor{Executor: fake}
+	if err := WaitForReboot(ctx, e, "old", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&e.reads); n != 2 {
+		t.Errorf("got %d reads", n)
+	}
+}
@@ -0,0 +1,29 @@
+package ioutils
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// TeeBuffer returns writer copying the data to w and buf.
+// buf alone is returned if w is nil
+func TeeBuffer(w io.Writer, buf *bytes.Buffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
+
+// SyncWriter serializes writes to W, e.g. stdout and stderr of a command
+// sharing the writer
+type SyncWriter struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (w *SyncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.W.Write(p)
+}
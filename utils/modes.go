@@ -0,0 +1,74 @@
+// Dry-run, recording and replay modes of the local commands
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+	"github.com/dorzheh/infra/utils/ioutils"
+)
+
+// LocalHost identifies the local host in dry-run logs and transcripts
+const LocalHost = "local"
+
+type runFunc func(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error)
+
+// withModes returns run logging the commands instead of running them
+// if dryRun is set, and recording or replaying them by the transcript
+func withModes(dryRun io.Writer, t *sshconf.Transcript, run runFunc) runFunc {
+	return func(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) (*sshconf.Result, error) {
+		switch {
+		case dryRun != nil:
+			sshconf.LogDryRun(dryRun, LocalHost, "run", command)
+			return &sshconf.Result{Command: command}, nil
+		case t != nil && t.Replaying():
+			res, err := t.Replay(LocalHost, "run", command)
+			if res != nil {
+				if stdout != nil {
+					io.WriteString(stdout, res.Stdout)
+				}
+				if stderr != nil {
+					io.WriteString(stderr, res.Stderr)
+				}
+				res.Stdout, res.Stderr = "", ""
+			}
+			return res, err
+		case t != nil:
+			if stdout != nil && stdout == stderr {
+				w := &ioutils.SyncWriter{W: stdout}
+				stdout, stderr = w, w
+			}
+			var outBuf, errBuf bytes.Buffer
+			res, err := run(ctx, command, stdin, ioutils.TeeBuffer(stdout, &outBuf), ioutils.TeeBuffer(stderr, &errBuf))
+			var recorded *sshconf.Result
+			if res != nil {
+				r := *res
+				r.Stdout, r.Stderr = outBuf.String(), errBuf.String()
+				recorded = &r
+			}
+			t.Record(LocalHost, "run", []string{command}, recorded, err)
+			return res, err
+		}
+		return run(ctx, command, stdin, stdout, stderr)
+	}
+}
+
+// mutateLocal does the local file change unless intercepted by the modes
+func mutateLocal(dryRun io.Writer, t *sshconf.Transcript, op string, args []string, fn func() error) error {
+	switch {
+	case dryRun != nil:
+		sshconf.LogDryRun(dryRun, LocalHost, op, args...)
+		return nil
+	case t != nil && t.Replaying():
+		_, err := t.Replay(LocalHost, op, args...)
+		return err
+	}
+	err := fn()
+	if t != nil {
+		t.Record(LocalHost, op, args, nil, err)
+	}
+	return err
+}
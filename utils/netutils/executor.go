@@ -0,0 +1,54 @@
+package netutils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/dorzheh/infra/utils"
+	"github.com/dorzheh/infra/utils/shellutils"
+)
+
+// GetIfaceAddrOn is like GetIfaceAddr but inspects the host of the executor
+func GetIfaceAddrOn(ctx context.Context, e utils.Executor, name string) (net.Addr, error) {
+	res, err := e.Run(ctx, "ip -4 -o addr show dev "+shellutils.Quote(name))
+	if err != nil {
+		return nil, err
+	}
+	// 2: eth0    inet 192.168.1.10/24 brd 192.168.1.255 scope global eth0
+	for _, line := range strings.Split(res.Stdout, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" {
+				continue
+			}
+			ip, ipnet, err := net.ParseCIDR(fields[i+1])
+			if err != nil {
+				return nil, err
+			}
+			ipnet.IP = ip
+			return ipnet, nil
+		}
+	}
+	return nil, ErrorNoIpv4
+}
+
+// GetBridgesOn is like GetLocalBridges but inspects the host of the executor
+func GetBridgesOn(ctx context.Context, e utils.Executor) ([]string, error) {
+	res, err := e.Run(ctx, "ls -1d /sys/class/net/*/bridge 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	var bridges []string
+	for _, line := range strings.Split(strings.TrimSpace(res.Stdout), "\n") {
+		// /sys/class/net/br0/bridge
+		if parts := strings.Split(line, "/"); len(parts) == 6 {
+			bridges = append(bridges, parts[4])
+		}
+	}
+	if len(bridges) == 0 {
+		return nil, errors.New("cannot find any bridge")
+	}
+	return bridges, nil
+}
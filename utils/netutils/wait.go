@@ -0,0 +1,25 @@
+package netutils
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/dorzheh/infra/utils"
+)
+
+// DialTimeout limits every connection attempt of WaitForPort
+var DialTimeout = 5 * time.Second
+
+// WaitForPort polls until TCP connection to addr ("host:port") succeeds.
+// Fails with utils.ErrWaitTimeout once timeout expires (no limit if zero)
+func WaitForPort(ctx context.Context, addr string, timeout time.Duration) error {
+	return utils.Poll(ctx, timeout, func(ctx context.Context) error {
+		d := net.Dialer{Timeout: DialTimeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
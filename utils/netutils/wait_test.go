@@ -0,0 +1,38 @@
+package netutils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/infra/utils"
+)
+
+func TestWaitForPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if err := WaitForPort(context.Background(), addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if err := WaitForPort(context.Background(), addr, 200*time.Millisecond); !errors.Is(err, utils.ErrWaitTimeout) {
+		t.Fatalf("closed port: got %v", err)
+	}
+
+	// the port starts listening while waiting
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if l, err := net.Listen("tcp", addr); err == nil {
+			t.Cleanup(func() { l.Close() })
+		}
+	}()
+	if err := WaitForPort(context.Background(), addr, 10*time.Second); err != nil {
+		t.Error(err)
+	}
+}
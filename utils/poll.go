@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+// ErrWaitTimeout is returned by Poll once the timeout expires
+var ErrWaitTimeout = errors.New("timed out waiting")
+
+// DefaultPollPolicy is the backoff of Poll: from 500ms up to 5s
+var DefaultPollPolicy = &sshconf.RetryPolicy{
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+}
+
+// Poll calls fn with backoff of DefaultPollPolicy until it succeeds,
+// returns an error marked by sshconf.Permanent, ctx is done or timeout
+// expires (no limit if zero).
+// ctx passed to fn expires with the timeout.
+// Once the timeout expires the error wraps ErrWaitTimeout and
+// mentions the last failure
+func Poll(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	parent := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	policy := *DefaultPollPolicy
+	policy.MaxAttempts = math.MaxInt32
+	policy.Deadline = 0
+	policy.Retryable = func(error) bool { return true }
+	err := policy.Do(ctx, fn)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	return fmt.Errorf("%w after %s: %s", ErrWaitTimeout, timeout, err)
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+// fastPoll shortens the backoff of Poll for the test
+func fastPoll(t *testing.T) {
+	saved := DefaultPollPolicy
+	DefaultPollPolicy = &sshconf.RetryPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond}
+	t.Cleanup(func() { DefaultPollPolicy = saved })
+}
+
+func TestPoll(t *testing.T) {
+	fastPoll(t)
+	attempts := 0
+	err := Poll(context.Background(), 0, func(context.Context) error {
+		if attempts++; attempts < 3 {
+			return errors.New("down")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+
+	failed := errors.New("failed")
+	attempts = 0
+	err = Poll(context.Background(), 0, func(context.Context) error {
+		attempts++
+		return sshconf.Permanent(failed)
+	})
+	if !errors.Is(err, failed) || attempts != 1 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	fastPoll(t)
+	start := time.Now()
+	err := Poll(context.Background(), 100*time.Millisecond, func(context.Context) error {
+		return errors.New("host is down")
+	})
+	if !errors.Is(err, ErrWaitTimeout) || !strings.Contains(err.Error(), "host is down") {
+		t.Errorf("got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %s", elapsed)
+	}
+}
+
+func TestPollCancel(t *testing.T) {
+	fastPoll(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := Poll(ctx, time.Minute, func(ctx context.Context) error {
+		// an attempt blocked until ctx is done
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+}
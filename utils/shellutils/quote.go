@@ -0,0 +1,31 @@
+// Shell quoting helpers
+
+package shellutils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// characters that never need quoting
+var safeExpr = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// Quote returns the string quoted for a POSIX shell
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if safeExpr.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Join quotes every argument and joins them into a single command line
+func Join(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
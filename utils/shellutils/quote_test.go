@@ -0,0 +1,21 @@
+package shellutils
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"":            "''",
+		"/tmp/a.txt":  "/tmp/a.txt",
+		"a b":         "'a b'",
+		"it's":        `'it'\''s'`,
+		"$HOME;ls":    "'$HOME;ls'",
+		"user@host:1": "user@host:1",
+	} {
+		if got := Quote(s); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", s, got, want)
+		}
+	}
+	if got := Join("ls", "-l", "my dir"); got != "ls -l 'my dir'" {
+		t.Errorf("Join: %s", got)
+	}
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultHookTimeout is used when Shutdown.HookTimeout is not set
+const DefaultHookTimeout = 30 * time.Second
+
+// Shutdown runs the registered cleanup hooks in reverse order of
+// registration once the process is signaled or Run is called:
+//
+//	s := utils.NewShutdown()
+//	s.Start()
+//	defer s.Run()
+//	s.AddFunc("sshfs", sshfs.DetachAll)
+//	s.Add("tmp", func(ctx context.Context) error { return os.RemoveAll(tmp) })
+//
+// On the first signal Context is canceled, the hooks are run and the
+// process exits.The second signal exits the process at once.
+// The zero value is ready to use
+type Shutdown struct {
+	// signals starting the shutdown (SIGHUP, SIGINT and SIGTERM if nil)
+	Signals []os.Signal
+	// max run time of a hook (DefaultHookTimeout if zero)
+	HookTimeout time.Duration
+	// errors of the hooks run on signal are written to Log (os.Stderr if nil)
+	Log io.Writer
+	// exits the process, os.Exit if nil.
+	// The status is 128 + signal number
+	Exit func(status int)
+
+	mu      sync.Mutex
+	hooks   []*Hook
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+	done    chan struct{}
+	err     error
+	signals chan os.Signal
+	stop    chan struct{}
+}
+
+// Hook is a cleanup registered by Add
+type Hook struct {
+	name    string
+	timeout time.Duration
+	fn      func(ctx context.Context) error
+	s       *Shutdown
+}
+
+func NewShutdown() *Shutdown {
+	return &Shutdown{}
+}
+
+// lazyInit makes the zero value usable.Must be called with mu held
+func (s *Shutdown) lazyInit() {
+	if s.done == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+	}
+}
+
+// Context is canceled once the shutdown starts
+func (s *Shutdown) Context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	return s.ctx
+}
+
+// Done is closed once the hooks have been run
+func (s *Shutdown) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lazyInit()
+	return s.done
+}
+
+// Add registers the hook.fn is called with context expiring after
+// HookTimeout
+func (s *Shutdown) Add(name string, fn func(ctx context.Context) error) *Hook {
+	return s.AddTimeout(name, 0, fn)
+}
+
+// AddFunc registers the hook ignoring the context
+func (s *Shutdown) AddFunc(name string, fn func() error) *Hook {
+	return s.Add(name, func(context.Context) error { return fn() })
+}
+
+// AddTimeout is like Add but the hook may run up to timeout
+// (HookTimeout if zero).
+// Once the shutdown has started, the hook is run at once and its error
+// is written to Log
+func (s *Shutdown) AddTimeout(name string, timeout time.Duration, fn func(ctx context.Context) error) *Hook {
+	h := &Hook{name: name, timeout: timeout, fn: fn, s: s}
+	s.mu.Lock()
+	started := s.started
+	if !started {
+		s.hooks = append(s.hooks, h)
+	}
+	s.mu.Unlock()
+	if started {
+		if err := s.runHook(h); err != nil {
+			fmt.Fprintf(s.log(), "shutdown: %s\n", err)
+		}
+	}
+	return h
+}
+
+// Remove deregisters the hook.Returns false if the hook has been
+// removed or run already
+func (h *Hook) Remove() bool {
+	s := h.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, hook := range s.hooks {
+		if hook == h {
+			s.hooks = append(s.hooks[:i], s.hooks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Start handles the signals until Stop is called
+func (s *Shutdown) Start() {
+	sigs := s.Signals
+	if sigs == nil {
+		sigs = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signals != nil {
+		return
+	}
+	s.lazyInit()
+	s.signals = make(chan os.Signal, 2)
+	s.stop = make(chan struct{})
+	signal.Notify(s.signals, sigs...)
+	go s.handle(s.signals, s.stop, s.done)
+}
+
+// Stop stops handling the signals.The hooks are not run
+func (s *Shutdown) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signals == nil {
+		return
+	}
+	signal.Stop(s.signals)
+	close(s.stop)
+	s.signals, s.stop = nil, nil
+}
+
+func (s *Shutdown) handle(signals chan os.Signal, stop, done chan struct{}) {
+	var sig os.Signal
+	select {
+	case sig = <-signals:
+	case <-stop:
+		return
+	}
+	status := exitStatus(sig)
+	go func() {
+		select {
+		case <-signals:
+			// second signal, do not wait for the hooks
+			s.exit(status)
+		case <-stop:
+		case <-done:
+		}
+	}()
+	if err := s.Run(); err != nil {
+		fmt.Fprintf(s.log(), "shutdown on %s: %s\n", sig, err)
+	}
+	s.exit(status)
+}
+
+func (s *Shutdown) log() io.Writer {
+	if s.Log == nil {
+		return os.Stderr
+	}
+	return s.Log
+}
+
+func (s *Shutdown) exit(status int) {
+	if s.Exit != nil {
+		s.Exit(status)
+		return
+	}
+	os.Exit(status)
+}
+
+func exitStatus(sig os.Signal) int {
+	if n, ok := sig.(syscall.Signal); ok {
+		return 128 + int(n)
+	}
+	return 1
+}
+
+// Run cancels Context and runs the hooks, the last registered first.
+// The hooks are run once, subsequent calls wait for them and
+// return the same error.
+// Errors of the hooks are joined, a hook running longer than its
+// timeout is abandoned
+func (s *Shutdown) Run() error {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.lazyInit()
+		s.started = true
+		s.cancel()
+		hooks := s.hooks
+		s.hooks = nil
+		s.mu.Unlock()
+		var errs []error
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if err := s.runHook(hooks[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		s.err = errors.Join(errs...)
+		close(s.done)
+	})
+	<-s.done
+	return s.err
+}
+
+func (s *Shutdown) runHook(h *Hook) error {
+	timeout := h.timeout
+	if timeout == 0 {
+		timeout = s.HookTimeout
+	}
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errc <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		errc <- h.fn(ctx)
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("%s: %w", h.name, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s: timed out after %s", h.name, timeout)
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	var s Shutdown
+	var order []string
+	hook := func(name string, err error) func() error {
+		return func() error {
+			order = append(order, name)
+			return err
+		}
+	}
+	failed := errors.New("failed")
+	s.AddFunc("first", hook("first", nil))
+	s.AddFunc("second", hook("second", failed))
+	removed := s.AddFunc("removed", hook("removed", nil))
+	s.AddFunc("last", hook("last", nil))
+	if !removed.Remove() || removed.Remove() {
+		t.Error("hook is not removed once")
+	}
+
+	ctx := s.Context()
+	err := s.Run()
+	if !errors.Is(err, failed) || !strings.HasPrefix(err.Error(), "second: ") {
+		t.Errorf("got %v", err)
+	}
+	if want := []string{"last", "second", "first"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got %q, want %q", order, want)
+	}
+	if ctx.Err() == nil {
+		t.Error("context is not canceled")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("done is not closed")
+	}
+	if err2 := s.Run(); err2 != err || len(order) != 3 {
+		t.Errorf("hooks are run again: %v %q", err2, order)
+	}
+}
+
+func TestShutdownAddAfterRun(t *testing.T) {
+	var log strings.Builder
+	s := &Shutdown{Log: &log}
+	s.Run()
+
+	ran := false
+	h := s.AddFunc("late", func() error {
+		ran = true
+		return errors.New("failed")
+	})
+	if !ran {
+		t.Fatal("hook added after the shutdown is not run")
+	}
+	if h.Remove() {
+		t.Error("hook run already is removed")
+	}
+	if want := "shutdown: late: failed\n"; log.String() != want {
+		t.Errorf("got %q, want %q", log.String(), want)
+	}
+}
+
+func TestShutdownHookTimeout(t *testing.T) {
+	s := NewShutdown()
+	s.HookTimeout = 50 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	ran := false
+	s.AddFunc("next", func() error {
+		ran = true
+		return nil
+	})
+	s.AddFunc("stuck", func() error {
+		<-block
+		return nil
+	})
+	s.AddTimeout("slow", 200*time.Millisecond, func(ctx context.Context) error {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	start := time.Now()
+	err := s.Run()
+	if err == nil || !strings.Contains(err.Error(), "stuck: timed out after 50ms") {
+		t.Errorf("got %v", err)
+	}
+	if strings.Contains(err.Error(), "slow") {
+		t.Errorf("timeout of the hook is ignored: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stuck hook is waited for %s", elapsed)
+	}
+	if !ran {
+		t.Error("hooks after the stuck one are not run")
+	}
+}
+
+func TestShutdownSignal(t *testing.T) {
+	exited := make(chan int, 2)
+	s := &Shutdown{
+		Signals: []os.Signal{syscall.SIGUSR1},
+		Log:     ioutil.Discard,
+		Exit:    func(status int) { exited <- status },
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.AddFunc("cleanup", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	s.Start()
+	defer s.Stop()
+
+	// the first signal runs the hooks
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hooks are not run")
+	}
+	if s.Context().Err() == nil {
+		t.Error("context is not canceled")
+	}
+
+	// the second one exits while the hook is still running
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	want := 128 + int(syscall.SIGUSR1)
+	select {
+	case status := <-exited:
+		if status != want {
+			t.Errorf("got %d, want %d", status, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second signal does not exit")
+	}
+	select {
+	case <-s.Done():
+		t.Error("hooks are done")
+	default:
+	}
+
+	close(release)
+	select {
+	case status := <-exited:
+		if status != want {
+			t.Errorf("got %d, want %d", status, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process does not exit after the hooks")
+	}
+}